@@ -0,0 +1,123 @@
+package consistenthashing
+
+import (
+	"math"
+	"sort"
+)
+
+// Release forgets the assignment of a key that no longer exists, freeing its share of the load in bounded load mode
+func (ch *ConsistentHashing) Release(shardKey string) {
+	ch.loadMu.Lock()
+	defer ch.loadMu.Unlock()
+	for _, owner := range ch.assignments[shardKey] {
+		ch.loads[owner]--
+	}
+	delete(ch.assignments, shardKey)
+}
+
+// Loads returns the number of keys assigned to every member in bounded load mode
+func (ch *ConsistentHashing) Loads() map[string]int {
+	ch.loadMu.Lock()
+	defer ch.loadMu.Unlock()
+	loads := make(map[string]int, len(ch.loads))
+	for member, load := range ch.loads {
+		loads[member] = load
+	}
+	return loads
+}
+
+// previousOwners returns the members that held key before a membership change, preferring its bounded load assignment
+func (ch *ConsistentHashing) previousOwners(previous *view, previousAssignments map[string][]string, key string) []string {
+	if owners, ok := previousAssignments[key]; ok {
+		return owners
+	}
+	return previous.placement.Locate(key, ch.replicas)
+}
+
+// nextOwners returns the members that hold key once next is published, preferring its bounded load assignment
+func (ch *ConsistentHashing) nextOwners(next *view, key string) []string {
+	if ch.capacityFactor > 0 {
+		ch.loadMu.Lock()
+		owners, ok := ch.assignments[key]
+		ch.loadMu.Unlock()
+		if ok {
+			return owners
+		}
+	}
+	return next.placement.Locate(key, ch.replicas)
+}
+
+/*
+assign returns the members key is assigned to, assigning it to members below capacity the first time it is seen. The
+membership snapshot is loaded under loadMu so an assignment always matches the membership it is recorded against.
+*/
+func (ch *ConsistentHashing) assign(key string) []string {
+	ch.loadMu.Lock()
+	defer ch.loadMu.Unlock()
+	return ch.assignLocked(ch.current.Load(), key)
+}
+
+func (ch *ConsistentHashing) assignLocked(v *view, key string) []string {
+	if owners, ok := ch.assignments[key]; ok {
+		return owners
+	}
+	owners := ch.boundedLocate(v, key)
+	for _, owner := range owners {
+		ch.loads[owner]++
+	}
+	ch.assignments[key] = owners
+	return owners
+}
+
+/*
+boundedLocate walks every member in the placement's order of preference for key and picks the first replication factor
+ones whose load is under capacity. A member's capacity is c times its weighted share of the load including the new key.
+*/
+func (ch *ConsistentHashing) boundedLocate(v *view, key string) []string {
+	members := v.placement.Members()
+	if len(members) == 0 {
+		return nil
+	}
+	total, totalWeight := ch.replicas, 0
+	for _, member := range members {
+		total += ch.loads[member]
+		totalWeight += v.weights[member]
+	}
+
+	candidates := v.placement.Locate(key, len(members))
+	var owners []string
+	for _, candidate := range candidates {
+		if len(owners) == ch.replicas {
+			break
+		}
+		capacity := math.Ceil(ch.capacityFactor * float64(total) * float64(v.weights[candidate]) / float64(totalWeight))
+		if float64(ch.loads[candidate]) < capacity {
+			owners = append(owners, candidate)
+		}
+	}
+	// only reachable when rounding leaves every member at capacity
+	for _, candidate := range candidates {
+		if len(owners) == ch.replicas {
+			break
+		}
+		if !contains(owners, candidate) {
+			owners = append(owners, candidate)
+		}
+	}
+	return owners
+}
+
+// reassign rebuilds every bounded load assignment against v, keys are visited in a stable order. loadMu must be held.
+func (ch *ConsistentHashing) reassign(v *view) {
+	keys := make([]string, 0, len(ch.assignments))
+	for key := range ch.assignments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ch.assignments = make(map[string][]string, len(keys))
+	ch.loads = make(map[string]int)
+	for _, key := range keys {
+		ch.assignLocked(v, key)
+	}
+}
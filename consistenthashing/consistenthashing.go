@@ -1,27 +1,136 @@
 package consistenthashing
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // HashingFunc lets me compose ConsistentHashing struct object with a plethora of different hashing algorithms
 type HashingFunc func(string) int
 
+// HashingFunc64 hashes onto the full 64-bit space, for rings that do not reduce positions modulo a ring size
+type HashingFunc64 func(string) uint64
+
+// ErrStaleEpoch rejects a compare-and-set membership change made against an epoch the cluster has moved on from
+var ErrStaleEpoch = errors.New("membership changed since the given epoch")
+
+// anyEpoch lets a membership change through whatever epoch the cluster is at
+const anyEpoch = math.MaxUint64
+
+// Option configures optional behaviour of a ConsistentHashing instance in New
+type Option func(*ConsistentHashing)
+
+// WithVirtualNodes places every member at n positions on the ring instead of one, smoothing out the key distribution
+func WithVirtualNodes(n int) Option {
+	return func(ch *ConsistentHashing) {
+		if n > 0 {
+			ch.vnodes = n
+		}
+	}
+}
+
+// WithReplicationFactor keeps n copies of every key on n distinct members, walking clockwise from the key's position
+func WithReplicationFactor(n int) Option {
+	return func(ch *ConsistentHashing) {
+		if n > 0 {
+			ch.replicas = n
+		}
+	}
+}
+
+/*
+WithHashSpace64 places members and keys on the full 64-bit hash space of h instead of hashFunc modulo ringSize, which
+removes the collisions and coarse granularity of small rings. It only applies to the default ring, build other
+placements with NewPartitioner64.
+*/
+func WithHashSpace64(h HashingFunc64) Option {
+	return func(ch *ConsistentHashing) {
+		ch.hash64 = h
+	}
+}
+
+// WithPartitioner swaps the classic ring for another placement algorithm, p is expected to have no members yet
+func WithPartitioner(p Partitioner) Option {
+	return func(ch *ConsistentHashing) {
+		ch.partitioner = p
+	}
+}
+
+/*
+WithBoundedLoad caps the keys assigned to a member at c times its fair share, as in "Consistent Hashing with Bounded
+Loads" (Mirrokni et al.). Lookups skip members at capacity and move on to the next member in preference order, so a
+hot range spills over onto its neighbours. c has to be greater than 1.
+*/
+func WithBoundedLoad(c float64) Option {
+	return func(ch *ConsistentHashing) {
+		if c > 1 {
+			ch.capacityFactor = c
+			ch.assignments = make(map[string][]string)
+			ch.loads = make(map[string]int)
+		}
+	}
+}
+
+// view is an immutable snapshot of cluster membership. Lookups load the current one without locking, membership changes
+// build a new one and publish it by swapping the pointer.
+type view struct {
+	// placement decides which members own a key
+	placement Partitioner
+	// weights scales the share of the key space of every member, giving bigger nodes a bigger share of the ring
+	weights map[string]int
+	// migration is set while keys are still moving from the previous membership to this one
+	migration *migration
+	// epoch counts the membership changes that led to this view, including ones that were rolled back
+	epoch uint64
+}
+
 type ConsistentHashing struct {
+	// The embedded mutex serialises membership changes, lookups never take it
 	sync.Mutex
 
-	// These routes are the endpoints exposed by every server in cluster to move data around during redistribution
-	allKeysRoute, removeKeyRoute, addKeyRoute, getKeyRoute string
-	hashFunc                                               HashingFunc
-	ringSize                                               int
-	ring                                                   *ring
+	// transferer moves data around during redistribution, by default over the routes passed to New
+	transferer Transferer
+	hashFunc   HashingFunc
+	ringSize   int
+	// hash64 replaces hashFunc and ringSize when the ring spans the full 64-bit hash space
+	hash64 HashingFunc64
+	// vnodes is the number of ring positions each physical member of weight 1 occupies
+	vnodes int
+	// replicas is the number of distinct members holding a copy of every key
+	replicas int
+	// partitioner is the empty placement the cluster starts from, by default the ring
+	partitioner Partitioner
+	current     atomic.Pointer[view]
+	// writeMu is held for reading by every write between routing it and forwarding it, so that a membership change
+	// only starts listing keys once writes routed by the previous membership have landed
+	writeMu sync.RWMutex
+	// capacityFactor is the bounded load factor c, 0 when loads are not bounded
+	capacityFactor float64
+	// assignments remembers the members every key was assigned to in bounded load mode, loads counts them per member.
+	// Both are guarded by loadMu, which bounded load lookups have to take since they assign keys as they go.
+	loadMu      sync.Mutex
+	assignments map[string][]string
+	loads       map[string]int
+	subscribers subscribers
+	// attempts and backoff configure retrying every step of moving a key, failurePolicy what happens when that fails
+	attempts      int
+	backoff       time.Duration
+	failurePolicy FailurePolicy
+	// parallelism is the number of keys moved at a time, the throttles pace them when set
+	parallelism   int
+	keysThrottle  *throttle
+	bytesThrottle *throttle
+	// journal records migrations for Recover, nil when no journal is kept
+	journal *journal
+	// stateFile is where the membership is saved every time it settles, empty when it is not saved
+	stateFile        string
+	fingerprintOnce  sync.Once
+	fingerprintValue string
 }
 
 func New(allKeysRoute string,
@@ -30,197 +139,646 @@ func New(allKeysRoute string,
 	getKeyRoute string,
 	hashFunc HashingFunc,
 	ringSize int,
+	opts ...Option,
 ) *ConsistentHashing {
-	return &ConsistentHashing{
-		allKeysRoute:   allKeysRoute,
-		removeKeyRoute: removeKeyRoute,
-		getKeyRoute:    getKeyRoute,
-		addKeyRoute:    addKeyRoute,
-		hashFunc:       hashFunc,
-		ringSize:       ringSize,
-		ring:           &ring{size: ringSize},
+	ch := &ConsistentHashing{
+		hashFunc:    hashFunc,
+		ringSize:    ringSize,
+		vnodes:      1,
+		replicas:    1,
+		attempts:    3,
+		backoff:     100 * time.Millisecond,
+		parallelism: 16,
+	}
+	for _, opt := range opts {
+		opt(ch)
+	}
+	if ch.transferer == nil {
+		ch.transferer = NewHTTPTransferer(newTransferClient(ch.parallelism), allKeysRoute, removeKeyRoute, addKeyRoute, getKeyRoute)
+	}
+	if ch.partitioner == nil && ch.hash64 != nil {
+		ch.partitioner = newRing64(ch.hash64, ch.vnodes)
+	} else if ch.partitioner == nil {
+		ch.partitioner = newRing(hashFunc, ringSize, ch.vnodes)
 	}
+	ch.current.Store(&view{placement: ch.partitioner, weights: map[string]int{}})
+	return ch
 }
 
 /*
 GetShard will find the first server where the shardKey's mapped keyId is greater than the serverPosition, then return the address of the
-next server while satisfying circular ring constraints
+next server while satisfying circular ring constraints. With replication this is the head of the key's preference list.
 */
 func (ch *ConsistentHashing) GetShard(shardKey string) (string, error) {
-	ch.Lock()
-	defer ch.Unlock()
-	keyPos := ch.hashFunc(shardKey) % ch.ringSize
-	log.Printf("Getting owning server for key with pos: %d \n", keyPos)
-	owner, err := ch.ring.getOwner(keyPos)
+	shards, err := ch.GetShards(shardKey)
 	if err != nil {
 		return "", err
 	}
-	log.Printf("Owner: %v \n", owner)
+	return shards[0], nil
+}
+
+/*
+GetShards returns the preference list of shardKey: the first replication factor distinct physical members found walking
+clockwise from the key's position, or in whatever order the configured Partitioner prefers them. The first entry is
+the member GetShard returns, fewer entries are returned when the cluster has fewer members than the replication factor.
+Lookups read the published membership snapshot and never wait on a membership change or the keys it is moving.
+*/
+func (ch *ConsistentHashing) GetShards(shardKey string) ([]string, error) {
+	return ch.lookup(ch.current.Load(), shardKey)
+}
+
+func (ch *ConsistentHashing) lookup(v *view, shardKey string) ([]string, error) {
+	var owners []string
+	if ch.capacityFactor > 0 {
+		owners = ch.assign(shardKey)
+	} else {
+		log.Printf("Getting owning servers for key %s using %s placement \n", shardKey, v.placement.Name())
+		owners = v.placement.Locate(shardKey, ch.replicas)
+	}
+	if len(owners) == 0 {
+		return nil, errors.New("no servers")
+	}
+	log.Printf("Owners: %v \n", owners)
 
-	return owner.address, nil
+	return owners, nil
 }
 
 /*
-AddMember Adds a server into our cluster while preserving consistent hashing constraints. It will iterate over the ring
-and find the first server where the nodeId is greater than current servers newly mapped id/position. Then we will insert
-a new server entity between the previous server and then server containing the value greater than newly mapped
-id/position.
+AddMember Adds a server into our cluster while preserving consistent hashing constraints. Every one of the server's
+virtual nodes is inserted in front of the first entry whose position is greater than the virtual node's mapped
+id/position. Each virtual node takes over a range of keys from its clockwise successors, so we redistribute from every
+member that held a replica of those ranges rather than from a single neighbour.
 */
 func (ch *ConsistentHashing) AddMember(serverAddr string) error {
+	return ch.AddMemberWithWeight(serverAddr, 1)
+}
+
+// AddMemberWithWeight adds a server that owns weight times as many virtual nodes as a member added through AddMember
+func (ch *ConsistentHashing) AddMemberWithWeight(serverAddr string, weight int) error {
+	_, err := ch.addMember(anyEpoch, serverAddr, weight)
+	return err
+}
+
+// CompareAndAddMember adds a server like AddMemberWithWeight, unless the epoch moved on from epoch. It returns the epoch
+// the cluster is at afterwards.
+func (ch *ConsistentHashing) CompareAndAddMember(epoch uint64, serverAddr string, weight int) (uint64, error) {
+	return ch.addMember(epoch, serverAddr, weight)
+}
+
+func (ch *ConsistentHashing) addMember(epoch uint64, serverAddr string, weight int) (uint64, error) {
+	if weight < 1 {
+		return 0, errors.New("weight must be at least 1")
+	}
+
 	ch.Lock()
 	defer ch.Unlock()
 
-	log.Println("Adding new server to cluster members")
+	current := ch.current.Load()
+	if epoch != anyEpoch && epoch != current.epoch {
+		return current.epoch, ErrStaleEpoch
+	}
+	if _, ok := current.weights[serverAddr]; ok {
+		return current.epoch, errors.New("server already in cluster")
+	}
+
+	log.Printf("Adding new server to cluster members with weight %d \n", weight)
 
-	nodePos := ch.hashFunc(serverAddr) % ch.ringSize
-	newNode := &ringMember{address: serverAddr, position: nodePos}
+	err := ch.changeMembership(serverAddr, weight, ch.failurePolicy)
+	return ch.current.Load().epoch, err
+}
 
-	log.Println("Adding new server into ring, new server pos: ", nodePos)
+/*
+SetWeight changes the weight of a live member. Growing a member places extra virtual nodes that only take over the
+ranges in front of them, shrinking it removes its highest virtual nodes and only the keys in their ranges move out.
+*/
+func (ch *ConsistentHashing) SetWeight(serverAddr string, weight int) error {
+	_, err := ch.setWeight(anyEpoch, serverAddr, weight)
+	return err
+}
 
-	// Insert in ring, and get the next node after it post-insertion
-	newInsertedAt := ch.ring.insert(newNode)
+// CompareAndSetWeight changes a member's weight like SetWeight, unless the epoch moved on from epoch. It returns the
+// epoch the cluster is at afterwards.
+func (ch *ConsistentHashing) CompareAndSetWeight(epoch uint64, serverAddr string, weight int) (uint64, error) {
+	return ch.setWeight(epoch, serverAddr, weight)
+}
 
-	if ch.ring.numServers() == 1 {
-		return nil
+func (ch *ConsistentHashing) setWeight(epoch uint64, serverAddr string, weight int) (uint64, error) {
+	if weight < 1 {
+		return 0, errors.New("weight must be at least 1")
 	}
-	next := ch.ring.getNextRingMember(newInsertedAt)
 
-	log.Printf("%v inserted at %d redistributing from server %v \n", newNode, newInsertedAt, next)
+	ch.Lock()
+	defer ch.Unlock()
+
+	current := ch.current.Load()
+	if epoch != anyEpoch && epoch != current.epoch {
+		return current.epoch, ErrStaleEpoch
+	}
+	currentWeight, ok := current.weights[serverAddr]
+	if !ok {
+		return current.epoch, errors.New("no server with address in cluster")
+	}
 
-	err := ch.redistribute(next, newNode, false)
+	log.Printf("Changing weight of %s from %d to %d \n", serverAddr, currentWeight, weight)
 
-	if err != nil {
-		log.Println(err)
-		return err
+	if weight == currentWeight {
+		return current.epoch, nil
 	}
 
-	return nil
+	err := ch.changeMembership(serverAddr, weight, ch.failurePolicy)
+	return ch.current.Load().epoch, err
 }
 
 func (ch *ConsistentHashing) RemoveMember(serverAddr string) error {
+	_, err := ch.removeMember(anyEpoch, serverAddr, ch.failurePolicy)
+	return err
+}
+
+// RemoveMemberWithPolicy removes a server like RemoveMember, but settles keys that cannot be moved according to policy
+// rather than the configured failure policy, as removing a member known to be dead calls for ContinueOnFailure
+func (ch *ConsistentHashing) RemoveMemberWithPolicy(serverAddr string, policy FailurePolicy) error {
+	_, err := ch.removeMember(anyEpoch, serverAddr, policy)
+	return err
+}
+
+// CompareAndRemoveMember removes a server like RemoveMember, unless the epoch moved on from epoch. It returns the epoch
+// the cluster is at afterwards.
+func (ch *ConsistentHashing) CompareAndRemoveMember(epoch uint64, serverAddr string) (uint64, error) {
+	return ch.removeMember(epoch, serverAddr, ch.failurePolicy)
+}
+
+func (ch *ConsistentHashing) removeMember(epoch uint64, serverAddr string, policy FailurePolicy) (uint64, error) {
 	ch.Lock()
 	defer ch.Unlock()
 
-	removeIdx := ch.ring.find(serverAddr)
+	log.Printf("Removing %s server \n", serverAddr)
 
-	log.Printf("Removing %s server from idx %d \n", serverAddr, removeIdx)
+	current := ch.current.Load()
+	if epoch != anyEpoch && epoch != current.epoch {
+		return current.epoch, ErrStaleEpoch
+	}
+	if _, ok := current.weights[serverAddr]; !ok {
+		return current.epoch, errors.New("no server with address in cluster")
+	}
+
+	err := ch.changeMembership(serverAddr, 0, policy)
+	return ch.current.Load().epoch, err
+}
+
+// ReplicationFactor is the number of members every key is kept on
+func (ch *ConsistentHashing) ReplicationFactor() int {
+	return ch.replicas
+}
+
+// CapacityFactor is the bounded load factor c, 0 when loads are not bounded
+func (ch *ConsistentHashing) CapacityFactor() float64 {
+	return ch.capacityFactor
+}
 
-	if removeIdx == -1 {
-		return errors.New("no server with address in cluster")
+// Epoch is bumped on every membership change, a caller holding an older one has a stale view of the cluster
+func (ch *ConsistentHashing) Epoch() uint64 {
+	return ch.current.Load().epoch
+}
+
+func (ch *ConsistentHashing) PrintTopology() {
+	v := ch.current.Load()
+	log.Printf("----Topology (%s placement, replication factor %d)----\n", v.placement.Name(), ch.replicas)
+	if r, ok := v.placement.(*ring); ok {
+		for idx, member := range r.partitionsRing {
+			log.Printf("idx %d: server %s (weight %d) vnode %d with pos %d\n", idx, member.address, v.weights[member.address], member.vnode, member.position)
+		}
+	} else {
+		for _, member := range v.placement.Members() {
+			log.Printf("server %s (weight %d)\n", member, v.weights[member])
+		}
 	}
+	log.Println("---------------")
+}
 
-	// move everything from current node into the next node
-	currNode, err := ch.ring.get(removeIdx)
-	if err != nil {
-		return err
+// Positions returns the ring positions of every virtual node of serverAddr after collisions were resolved, nil when the
+// member is unknown or the placement is not the ring
+func (ch *ConsistentHashing) Positions(serverAddr string) []uint64 {
+	r, ok := ch.current.Load().placement.(*ring)
+	if !ok || r.find(serverAddr) == -1 {
+		return nil
 	}
+	return r.positions(serverAddr)
+}
 
-	successor := ch.ring.getNextRingMember(removeIdx)
+/*
+changeMembership places serverAddr with the given weight, or removes it for a weight of 0, then moves keys from every
+member that may hold one whose preference list changed. The new membership is published together with the migration
+before any key moves, so that writes already land on the new owners and reads can fall back on the previous ones. Once
+every key moved the migration is dropped. When keys could not be moved and the failure policy aborts, the previous
+membership is published again instead, after moving writes made in the meantime back to the previous owners.
+*/
+func (ch *ConsistentHashing) changeMembership(serverAddr string, weight int, policy FailurePolicy) error {
+	previous := ch.current.Load()
+	next := &view{weights: copyWeights(previous.weights), epoch: previous.epoch + 1}
+
+	if weight == 0 {
+		next.placement = previous.placement.Remove(serverAddr)
+		delete(next.weights, serverAddr)
+	} else {
+		placement, err := previous.placement.Add(serverAddr, weight)
+		if err != nil {
+			return err
+		}
+		next.placement = placement
+		next.weights[serverAddr] = weight
+	}
 
-	err = ch.redistribute(currNode, successor, true)
+	// writes still routed by the previous migration land before its journal is replaced
+	ch.writeMu.Lock()
+	err := ch.journal.begin(journalRecord{
+		Type:     journalBegin,
+		Epoch:    next.epoch,
+		Member:   serverAddr,
+		Previous: memberStates(previous),
+		Next:     memberStates(next),
+	})
+	ch.writeMu.Unlock()
 	if err != nil {
-		log.Printf("Error redistributing %s \n", err.Error())
 		return err
 	}
 
-	// now remove currNode from the ring
-	err = ch.ring.remove(removeIdx)
-	if err != nil {
-		return err
+	previousAssignments, previousLoads := ch.publish(next)
+
+	changed := Event{Type: MemberAdded, Epoch: next.epoch, Member: serverAddr, Weight: weight}
+	if weight == 0 {
+		changed.Type = MemberRemoved
+	} else if _, ok := previous.weights[serverAddr]; ok {
+		changed.Type = MemberWeightChanged
 	}
+	ch.emit(changed)
+	ch.emit(Event{Type: MigrationStarted, Epoch: next.epoch, Member: serverAddr})
+
+	settled := &view{placement: next.placement, weights: next.weights, epoch: next.epoch}
 
+	// nothing to move into an empty cluster, and nowhere to move to out of one
+	if len(previous.placement.Members()) == 0 || len(next.placement.Members()) == 0 {
+		ch.current.Store(settled)
+		ch.saveState()
+		ch.journal.finish(journalCommit)
+		ch.emit(Event{Type: MigrationFinished, Epoch: next.epoch, Member: serverAddr})
+		return nil
+	}
+
+	migrationErr := ch.redistributeFrom(ch.sources(previous, next, serverAddr), previous, previousAssignments, next, policy)
+	if migrationErr != nil && migrationErr.RolledBack {
+		ch.writeMu.Lock()
+		ch.restoreWrites(previous, previousAssignments, next)
+		ch.loadMu.Lock()
+		// rolling back is a change of its own, so the epoch keeps moving forward
+		ch.current.Store(&view{placement: previous.placement, weights: previous.weights, epoch: next.epoch + 1})
+		ch.assignments, ch.loads = previousAssignments, previousLoads
+		ch.loadMu.Unlock()
+		ch.writeMu.Unlock()
+		ch.saveState()
+		ch.journal.finish(journalAbort)
+		ch.emit(Event{Type: MigrationFailed, Epoch: next.epoch + 1, Member: serverAddr, Err: migrationErr})
+		return migrationErr
+	}
+
+	ch.current.Store(settled)
+	ch.saveState()
+	ch.journal.finish(journalCommit)
+	if migrationErr != nil {
+		ch.emit(Event{Type: MigrationFinished, Epoch: next.epoch, Member: serverAddr, Err: migrationErr})
+		return migrationErr
+	}
+	ch.emit(Event{Type: MigrationFinished, Epoch: next.epoch, Member: serverAddr})
 	return nil
 }
 
-func (ch *ConsistentHashing) PrintTopology() {
-	ch.Lock()
-	defer ch.Unlock()
-	log.Println("----Topology----")
-	for idx, member := range ch.ring.partitionsRing {
-		log.Printf("idx %d: server %s with pos %d\n", idx, member.address, member.position)
+/*
+publish makes next, migrating from the current membership, the membership lookups see. It waits for writes routed by the
+current membership to land first. In bounded load mode every assignment is rebuilt against next under the same lock
+lookups assign keys under, and the assignments from before are returned.
+*/
+func (ch *ConsistentHashing) publish(next *view) (map[string][]string, map[string]int) {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	ch.loadMu.Lock()
+	defer ch.loadMu.Unlock()
+
+	previousAssignments, previousLoads := ch.assignments, ch.loads
+	next.migration = newMigration(ch.current.Load(), previousAssignments)
+	ch.current.Store(next)
+	if ch.capacityFactor > 0 {
+		ch.reassign(next)
 	}
-	log.Println("---------------")
+	return previousAssignments, previousLoads
 }
 
-func (ch *ConsistentHashing) redistribute(from *ringMember, to *ringMember, isRemoval bool) error {
-	resp, err := http.Get("http://" + from.address + ch.allKeysRoute)
-	if err != nil {
-		return err
-	}
-	var decodedResp allKeysResponse
-	err = json.NewDecoder(resp.Body).Decode(&decodedResp)
-	if err != nil {
-		return err
+/*
+sources returns the members that may hold a key whose preference list changed when serverAddr changed between the
+previous placement and the next one. The ring can narrow this down to the neighbours of the virtual nodes that changed,
+for any other placement, or when bounded loads let keys spill anywhere, every previous member is a candidate.
+*/
+func (ch *ConsistentHashing) sources(previous *view, next *view, serverAddr string) []string {
+	prevRing, prevOk := previous.placement.(*ring)
+	nextRing, nextOk := next.placement.(*ring)
+	if prevOk && nextOk && ch.capacityFactor == 0 {
+		return nextRing.affectedBy(prevRing, serverAddr, ch.replicas)
 	}
-	fmt.Println("redistributing from ", from, ", to ", to)
+	return previous.placement.Members()
+}
 
-	var wg sync.WaitGroup
-	for _, key := range decodedResp.Keys {
-		keyId := ch.hashFunc(key) % ch.ringSize
-		correctPlacement, err := ch.ring.getOwner(keyId)
+/*
+redistributeFrom lists the keys of every source and moves them in two phases: every key is first copied to the members
+that joined its preference list, and only then do members drop the keys they no longer own, so an aborted migration
+never lost a copy. A step that keeps failing after every retry is collected instead of stopping the migration. Under
+AbortOnFailure any failed listing or copy skips the drop phase and the error asks for a rollback, once the drop phase
+started failures are reported but the new membership stays.
+*/
+func (ch *ConsistentHashing) redistributeFrom(sources []string, previous *view, previousAssignments map[string][]string, next *view, policy FailurePolicy) *MigrationError {
+	var failures []KeyError
+	var tasks []*moveTask
+	for _, source := range sources {
+		log.Printf("Redistributing from server %s \n", source)
+		var keys []string
+		err := ch.retry(func() error {
+			var err error
+			keys, err = ch.transferer.ListKeys(source)
+			return err
+		})
 		if err != nil {
 			log.Println(err)
+			failures = append(failures, KeyError{Member: source, Op: OpList, Err: err})
 			continue
 		}
-		if (correctPlacement.address == to.address) || isRemoval {
-			log.Println("Moving key ", key, " from ", from, ", to ", to)
-			wg.Add(1)
-			go func(wg *sync.WaitGroup, key string, removeKeyRoute string, addKeyRoute string, getKeyRoute string) {
-				defer wg.Done()
-
-				client := &http.Client{}
-
-				// Get Key Val from fromMem
-				getKeyUrl := "http://" + from.address + getKeyRoute + "?key=" + key
-				resp, err := client.Get(getKeyUrl)
-				if err != nil {
-					log.Println("Error getting key")
-					log.Println(err)
-					return
-				}
-				if resp.StatusCode != http.StatusOK {
-					log.Printf("Get key response unsuccessful got %d for request to %s \n", resp.StatusCode, getKeyUrl)
-					return
-				}
-				buf, err := io.ReadAll(resp.Body)
-				_ = resp.Body.Close()
-				respBody := bytes.NewBuffer(buf)
-
-				// Add key val to toMem
-				resp, err = client.Post("http://"+to.address+addKeyRoute, resp.Header.Get("Content-Type"), respBody)
-				if err != nil {
-					log.Println("Error adding key")
-					log.Println(err)
-					return
-				}
-				if resp.StatusCode != http.StatusCreated {
-					log.Print("Post key val response unsuccessful")
-					return
-				}
+		tasks = append(tasks, ch.redistribute(source, keys, previous, previousAssignments, next)...)
+	}
+	if len(failures) > 0 && policy == AbortOnFailure {
+		return &MigrationError{RolledBack: true, Failures: failures}
+	}
+	for i, task := range tasks {
+		ch.journal.append(journalRecord{Type: journalPlan, Key: task.key, From: task.from, To: task.targets, Drop: task.drop}, i == len(tasks)-1)
+	}
 
-				// remove key val from fromMem
-				removeUrl := "http://" + from.address + removeKeyRoute + "?key=" + key
-				req, err := http.NewRequest(http.MethodDelete, removeUrl, nil)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				resp, err = client.Do(req)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				if resp.StatusCode != http.StatusOK {
-					log.Printf("Delete response unsuccessful got %d on request to %s \n", resp.StatusCode, removeUrl)
-					return
+	failures = append(failures, ch.runTasks(tasks, func(task *moveTask) *KeyError {
+		return ch.copyKey(task, next)
+	})...)
+	if len(failures) > 0 && policy == AbortOnFailure {
+		ch.undoCopies(tasks)
+		return &MigrationError{RolledBack: true, Failures: failures}
+	}
+	// from here on the migration is finished rather than undone, even after a crash
+	ch.journal.append(journalRecord{Type: journalCopyDone}, true)
+
+	failures = append(failures, ch.runTasks(tasks, func(task *moveTask) *KeyError {
+		return ch.dropKey(task, next)
+	})...)
+	if len(failures) > 0 {
+		return &MigrationError{Failures: failures}
+	}
+	return nil
+}
+
+// moveTask is a key from has to copy to the members that joined its preference list, drop, or both
+type moveTask struct {
+	from    string
+	key     string
+	targets []string
+	drop    bool
+	// copiedTo are the targets that stored the key, failed is set when the key must stay on from
+	copiedTo []string
+	failed   bool
+}
+
+/*
+redistribute works out what has to happen to the keys held by from to bring them in line with the next membership,
+given the membership as it was before the change. For every key the first member of its previous preference list copies
+it to the members that joined the list, and from drops its own copy once it is no longer part of the list.
+*/
+func (ch *ConsistentHashing) redistribute(from string, keys []string, previous *view, previousAssignments map[string][]string, next *view) []*moveTask {
+	fmt.Println("redistributing from ", from)
+
+	var tasks []*moveTask
+	for _, key := range keys {
+		oldOwners := ch.previousOwners(previous, previousAssignments, key)
+		newOwners := ch.nextOwners(next, key)
+
+		var targets []string
+		if len(oldOwners) == 0 || oldOwners[0] == from || !contains(oldOwners, from) {
+			for _, owner := range newOwners {
+				if owner != from && !contains(oldOwners, owner) {
+					targets = append(targets, owner)
 				}
-			}(&wg, key, ch.removeKeyRoute, ch.addKeyRoute, ch.getKeyRoute)
+			}
+		}
+		drop := !contains(newOwners, from)
+		if len(targets) == 0 && !drop {
+			continue
 		}
+
+		log.Println("Moving key ", key, " from ", from, ", to ", targets)
+		tasks = append(tasks, &moveTask{from: from, key: key, targets: targets, drop: drop})
+	}
+	return tasks
+}
+
+// runTasks runs step for every task on a pool of parallelism workers and collects the steps that failed
+func (ch *ConsistentHashing) runTasks(tasks []*moveTask, step func(task *moveTask) *KeyError) []KeyError {
+	queue := make(chan *moveTask)
+	var mu sync.Mutex
+	var failures []KeyError
+	var wg sync.WaitGroup
+	for i := 0; i < ch.parallelism && i < len(tasks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				if failure := step(task); failure != nil {
+					log.Println(failure)
+					mu.Lock()
+					failures = append(failures, *failure)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
 	}
+	close(queue)
 	wg.Wait()
+	return failures
+}
+
+/*
+copyKey reads the task's key from its holder and stores it on every target. Keys written since the migration started
+already live on their new owners, copying would overwrite them, and keys deleted since they were listed have nothing
+left to copy.
+*/
+func (ch *ConsistentHashing) copyKey(task *moveTask, next *view) *KeyError {
+	if len(task.targets) == 0 {
+		return nil
+	}
+	// throttled before the copy begins, writes to the key would otherwise wait on the throttle too
+	ch.keysThrottle.wait(1)
+	if !next.migration.beginCopy(task.key) {
+		return nil
+	}
+	defer next.migration.endCopy(task.key)
+
+	var value []byte
+	err := ch.retry(func() error {
+		var err error
+		value, err = ch.transferer.Fetch(task.from, task.key)
+		return err
+	})
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		task.failed = true
+		ch.journal.append(journalRecord{Type: journalFailed, Key: task.key, From: task.from}, false)
+		return &KeyError{Key: task.key, Member: task.from, Op: OpFetch, Err: err}
+	}
+
+	for _, to := range task.targets {
+		ch.bytesThrottle.wait(len(value))
+		err := ch.retry(func() error {
+			return ch.transferer.Store(to, task.key, value)
+		})
+		if err != nil {
+			task.failed = true
+			ch.journal.append(journalRecord{Type: journalFailed, Key: task.key, From: task.from}, false)
+			return &KeyError{Key: task.key, Member: to, Op: OpStore, Err: err}
+		}
+		task.copiedTo = append(task.copiedTo, to)
+		ch.journal.append(journalRecord{Type: journalCopied, Key: task.key, From: task.from, To: []string{to}}, false)
+	}
+	return nil
+}
+
+// dropKey removes the task's key from its holder once it no longer belongs there, unless copying it failed
+func (ch *ConsistentHashing) dropKey(task *moveTask, next *view) *KeyError {
+	if task.failed {
+		return nil
+	}
+	if task.drop {
+		err := ch.retry(func() error {
+			return ch.transferer.Delete(task.from, task.key)
+		})
+		if err != nil {
+			return &KeyError{Key: task.key, Member: task.from, Op: OpDelete, Err: err}
+		}
+		ch.journal.append(journalRecord{Type: journalDeleted, Key: task.key, From: task.from}, false)
+	}
+	if len(task.copiedTo) > 0 || task.drop {
+		ch.emit(Event{Type: KeyMoved, Epoch: next.epoch, Key: task.key, From: task.from, To: task.copiedTo, Dropped: task.drop})
+	}
 	return nil
 }
 
-type allKeysResponse struct {
-	Keys []string `json:"keys"`
+// undoCopies removes the copies an aborted migration made, the previous owners never dropped theirs
+func (ch *ConsistentHashing) undoCopies(tasks []*moveTask) {
+	ch.runTasks(tasks, func(task *moveTask) *KeyError {
+		for _, to := range task.copiedTo {
+			err := ch.retry(func() error {
+				return ch.transferer.Delete(to, task.key)
+			})
+			if err != nil {
+				return &KeyError{Key: task.key, Member: to, Op: OpDelete, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+/*
+restoreWrites brings keys written while an aborted migration was in flight back to their previous owners, since those
+writes only went to the new ones. A key deleted in the meantime is deleted from its previous owners too. It has to run
+while writes are held off, so nothing lands on the previous owners before it is done.
+*/
+func (ch *ConsistentHashing) restoreWrites(previous *view, previousAssignments map[string][]string, next *view) {
+	for _, key := range next.migration.writtenKeys() {
+		ch.restoreWrite(key, ch.previousOwners(previous, previousAssignments, key), ch.nextOwners(next, key))
+	}
+}
+
+// restoreWrite moves key from newOwners, which got written to, back to oldOwners
+func (ch *ConsistentHashing) restoreWrite(key string, oldOwners []string, newOwners []string) {
+	var value []byte
+	var fetchErr error
+	for _, owner := range newOwners {
+		fetchErr = ch.retry(func() error {
+			var err error
+			value, err = ch.transferer.Fetch(owner, key)
+			return err
+		})
+		if fetchErr == nil {
+			break
+		}
+	}
+
+	for _, owner := range oldOwners {
+		if contains(newOwners, owner) {
+			continue
+		}
+		err := fetchErr
+		if errors.Is(fetchErr, ErrKeyNotFound) {
+			err = ch.retry(func() error {
+				return ch.transferer.Delete(owner, key)
+			})
+		} else if fetchErr == nil {
+			err = ch.retry(func() error {
+				return ch.transferer.Store(owner, key, value)
+			})
+		}
+		if err != nil {
+			log.Printf("Could not restore key %s on %s: %v \n", key, owner, err)
+		}
+	}
+
+	// the new owners keep the only copy of a write that could not be read back
+	if fetchErr != nil && !errors.Is(fetchErr, ErrKeyNotFound) {
+		return
+	}
+	for _, owner := range newOwners {
+		if !contains(oldOwners, owner) {
+			_ = ch.retry(func() error {
+				return ch.transferer.Delete(owner, key)
+			})
+		}
+	}
+}
+
+// retry runs step up to the configured number of attempts, backing off exponentially between them
+func (ch *ConsistentHashing) retry(step func() error) error {
+	backoff := ch.backoff
+	var err error
+	for attempt := 0; attempt < ch.attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = step()
+		// a missing key will not show up by asking again
+		if err == nil || errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+// vnodeKey is what gets hashed to place a virtual node. The first virtual node hashes the bare address so a cluster
+// with a single virtual node per member keeps the placement it always had
+func vnodeKey(serverAddr string, vnode int) string {
+	if vnode == 0 {
+		return serverAddr
+	}
+	return fmt.Sprintf("%s#%d", serverAddr, vnode)
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
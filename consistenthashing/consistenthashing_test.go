@@ -0,0 +1,602 @@
+package consistenthashing
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode is an in-process stand-in for a node server exposing the routes redistribute relies on
+type testNode struct {
+	mu    sync.Mutex
+	store map[string]string
+	srv   *httptest.Server
+	// listGate, when set, holds listing keys back until it is closed
+	listGate chan struct{}
+}
+
+func newTestNode(t *testing.T) *testNode {
+	node := &testNode{store: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if node.listGate != nil {
+			<-node.listGate
+		}
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		keys := []string{}
+		for key := range node.store {
+			keys = append(keys, key)
+		}
+		_ = json.NewEncoder(w).Encode(allKeysResponse{Keys: keys})
+	})
+	mux.HandleFunc("/key", func(w http.ResponseWriter, r *http.Request) {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			key := r.URL.Query().Get("key")
+			val, ok := node.store[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"key": key, "value": val})
+		case http.MethodPost:
+			data := map[string]string{}
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			node.store[data["key"]] = data["value"]
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			delete(node.store, r.URL.Query().Get("key"))
+		}
+	})
+	node.srv = httptest.NewServer(mux)
+	t.Cleanup(node.srv.Close)
+	return node
+}
+
+func (n *testNode) addr() string {
+	return strings.TrimPrefix(n.srv.URL, "http://")
+}
+
+func (n *testNode) keys() map[string]string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	keys := make(map[string]string, len(n.store))
+	for k, v := range n.store {
+		keys[k] = v
+	}
+	return keys
+}
+
+// testHash mixes FNV-1a, on its own it spreads addresses that only differ in a port number poorly
+func testHash(s string) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return int(mix64(h.Sum64()) >> 1)
+}
+
+func newTestConsistentHashing(opts ...Option) *ConsistentHashing {
+	return New("/keys", "/key", "/key", "/key", testHash, 1000003, opts...)
+}
+
+// upload stores a key on whichever node the ring currently routes it to
+func upload(t *testing.T, ch *ConsistentHashing, nodes map[string]*testNode, key string) {
+	shard, err := ch.GetShard(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := nodes[shard]
+	node.mu.Lock()
+	node.store[key] = "val-" + key
+	node.mu.Unlock()
+}
+
+// assertPlacement checks that every node holds exactly the keys the ring routes to it
+func assertPlacement(t *testing.T, ch *ConsistentHashing, nodes map[string]*testNode, total int) {
+	t.Helper()
+	seen := 0
+	for addr, node := range nodes {
+		for key := range node.keys() {
+			seen++
+			shard, err := ch.GetShard(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shard != addr {
+				t.Errorf("key %s lives on %s but routes to %s", key, addr, shard)
+			}
+		}
+	}
+	if seen != total {
+		t.Errorf("expected %d keys across the cluster, found %d", total, seen)
+	}
+}
+
+func TestConsistentHashing_AddRemoveMemberWithVirtualNodes(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(16))
+	nodes := make(map[string]*testNode)
+	var order []string
+	for i := 0; i < 4; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+
+	if err := ch.AddMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddMember(order[0]); err == nil {
+		t.Error("expected adding a duplicate member to fail")
+	}
+	total := 300
+	for i := 0; i < total; i++ {
+		upload(t, ch, nodes, fmt.Sprintf("key-%d", i))
+	}
+
+	for _, addr := range order[1:] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+		assertPlacement(t, ch, nodes, total)
+	}
+
+	for addr, node := range nodes {
+		if len(node.keys()) == 0 {
+			t.Errorf("expected %s to own part of the key space", addr)
+		}
+	}
+
+	if err := ch.RemoveMember(order[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes[order[1]].keys()) != 0 {
+		t.Error("expected removed member to be drained")
+	}
+	delete(nodes, order[1])
+	assertPlacement(t, ch, nodes, total)
+
+	if err := ch.RemoveMember(order[1]); err == nil {
+		t.Error("expected removing an unknown member to fail")
+	}
+}
+
+func TestConsistentHashing_WeightedMembers(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(8))
+	nodes := make(map[string]*testNode)
+	light, heavy := newTestNode(t), newTestNode(t)
+	nodes[light.addr()] = light
+	nodes[heavy.addr()] = heavy
+
+	if err := ch.AddMemberWithWeight(light.addr(), 0); err == nil {
+		t.Error("expected a zero weight to be rejected")
+	}
+	if err := ch.AddMember(light.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddMemberWithWeight(heavy.addr(), 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.current.Load().placement.(*ring).findAll(heavy.addr())) != 32 {
+		t.Errorf("expected 32 vnodes for weight 4, got %d", len(ch.current.Load().placement.(*ring).findAll(heavy.addr())))
+	}
+
+	total := 400
+	for i := 0; i < total; i++ {
+		upload(t, ch, nodes, fmt.Sprintf("key-%d", i))
+	}
+	if len(heavy.keys()) <= len(light.keys()) {
+		t.Errorf("expected heavier member to own more keys, got %d vs %d", len(heavy.keys()), len(light.keys()))
+	}
+
+	if err := ch.SetWeight(heavy.addr(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.current.Load().placement.(*ring).findAll(heavy.addr())) != 8 {
+		t.Errorf("expected 8 vnodes after shrinking, got %d", len(ch.current.Load().placement.(*ring).findAll(heavy.addr())))
+	}
+	assertPlacement(t, ch, nodes, total)
+
+	if err := ch.SetWeight(light.addr(), 3); err != nil {
+		t.Fatal(err)
+	}
+	assertPlacement(t, ch, nodes, total)
+
+	if err := ch.SetWeight("unknown:1", 2); err == nil {
+		t.Error("expected changing the weight of an unknown member to fail")
+	}
+}
+
+// assertReplicas checks that every key is held by exactly the members of its preference list
+func assertReplicas(t *testing.T, ch *ConsistentHashing, nodes map[string]*testNode, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		shards, err := ch.GetShards(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for addr, node := range nodes {
+			_, held := node.keys()[key]
+			if held != contains(shards, addr) {
+				t.Errorf("key %s held by %s: %v, preference list %v", key, addr, held, shards)
+			}
+		}
+	}
+}
+
+func TestConsistentHashing_ReplicationFactor(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(4), WithReplicationFactor(3))
+	nodes := make(map[string]*testNode)
+	var order []string
+	for i := 0; i < 5; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+
+	for _, addr := range order[:2] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		shards, err := ch.GetShards(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shards) != 2 {
+			t.Fatalf("expected both members in the preference list, got %v", shards)
+		}
+		for _, shard := range shards {
+			nodes[shard].mu.Lock()
+			nodes[shard].store[key] = "val-" + key
+			nodes[shard].mu.Unlock()
+		}
+	}
+
+	for _, addr := range order[2:] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+		assertReplicas(t, ch, nodes, keys)
+	}
+
+	if err := ch.SetWeight(order[3], 3); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicas(t, ch, nodes, keys)
+
+	if err := ch.RemoveMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	delete(nodes, order[0])
+	assertReplicas(t, ch, nodes, keys)
+
+	if err := ch.SetWeight(order[3], 1); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicas(t, ch, nodes, keys)
+}
+
+func TestConsistentHashing_BoundedLoad(t *testing.T) {
+	ch := newTestConsistentHashing(WithBoundedLoad(1.25))
+	nodes := make(map[string]*testNode)
+	var order []string
+	for i := 0; i < 4; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+	for _, addr := range order[:3] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := 300
+	for i := 0; i < total; i++ {
+		upload(t, ch, nodes, fmt.Sprintf("key-%d", i))
+	}
+	// with a single position per member the ring alone is far from balanced, the bound has to hold regardless
+	for member, load := range ch.Loads() {
+		if load > 125 {
+			t.Errorf("%s holds %d keys, more than 1.25 times the average of 100", member, load)
+		}
+	}
+
+	if err := ch.AddMember(order[3]); err != nil {
+		t.Fatal(err)
+	}
+	assertPlacement(t, ch, nodes, total)
+	for member, load := range ch.Loads() {
+		if load > 94 {
+			t.Errorf("%s holds %d keys after growing, more than 1.25 times the average of 75", member, load)
+		}
+		if load != len(nodes[member].keys()) {
+			t.Errorf("%s is assigned %d keys but holds %d", member, load, len(nodes[member].keys()))
+		}
+	}
+
+	if err := ch.RemoveMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	delete(nodes, order[0])
+	assertPlacement(t, ch, nodes, total)
+
+	ch.Release("key-0")
+	sum := 0
+	for _, load := range ch.Loads() {
+		sum += load
+	}
+	if sum != total-1 {
+		t.Errorf("expected releasing a key to free its load, total load is %d", sum)
+	}
+}
+
+func TestConsistentHashing_LookupsDoNotWaitOnRebalancing(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(4))
+	first, second := newTestNode(t), newTestNode(t)
+	first.listGate = make(chan struct{})
+
+	if err := ch.AddMember(first.addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(chan error)
+	go func() {
+		added <- ch.AddMember(second.addr())
+	}()
+
+	// the new member is published before redistribution starts listing keys on the first one
+	deadline := time.After(5 * time.Second)
+	for {
+		owners := ch.current.Load().placement.Members()
+		if len(owners) == 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("new membership was never published")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	lookedUp := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := ch.GetShard(fmt.Sprintf("key-%d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+		close(lookedUp)
+	}()
+
+	select {
+	case <-lookedUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookups blocked on the membership change")
+	}
+
+	close(first.listGate)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsistentHashing_RoutingDuringMigration(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(4))
+	oldOwner, newOwner := newTestNode(t), newTestNode(t)
+	nodes := map[string]*testNode{oldOwner.addr(): oldOwner, newOwner.addr(): newOwner}
+	if err := ch.AddMember(oldOwner.addr()); err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(100)
+	for _, key := range keys {
+		upload(t, ch, nodes, key)
+	}
+
+	oldOwner.listGate = make(chan struct{})
+	added := make(chan error)
+	go func() {
+		added <- ch.AddMember(newOwner.addr())
+	}()
+	for ch.current.Load().migration == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	var moving []string
+	for _, key := range keys {
+		route, err := ch.Route(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Shards[0] == newOwner.addr() {
+			if len(route.Fallback) != 1 || route.Fallback[0] != oldOwner.addr() {
+				t.Errorf("expected %s to fall back on its previous owner, got %v", key, route.Fallback)
+			}
+			moving = append(moving, key)
+		}
+	}
+	if len(moving) == 0 {
+		t.Fatal("expected the new member to take over some keys")
+	}
+
+	// overwrite a moving key on its new owner while the migration is still waiting to copy it
+	route, done, err := ch.BeginWrite(moving[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOwner.mu.Lock()
+	newOwner.store[moving[0]] = "updated"
+	newOwner.mu.Unlock()
+	done()
+	if route.Shards[0] != newOwner.addr() {
+		t.Errorf("expected the write to go to the new owner, got %v", route.Shards)
+	}
+	if route, _ := ch.Route(moving[0]); len(route.Fallback) != 0 {
+		t.Error("expected no fallback for a key written during the migration")
+	}
+
+	close(oldOwner.listGate)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	assertPlacement(t, ch, nodes, len(keys))
+	if val := newOwner.keys()[moving[0]]; val != "updated" {
+		t.Errorf("expected the write made during the migration to survive, got %q", val)
+	}
+	if ch.current.Load().migration != nil {
+		t.Error("expected the migration to be dropped once keys moved")
+	}
+}
+
+func TestConsistentHashing_CollidingMembers(t *testing.T) {
+	// every member address hashes onto the same position until it is salted, and salted ones spread evenly rather
+	// than wherever their random port happens to put them
+	var order []string
+	hash := func(s string) int {
+		if !strings.HasPrefix(s, "127.0.0.1") {
+			return testHash(s)
+		}
+		if !strings.Contains(s, "~") {
+			return 4242
+		}
+		for i, addr := range order {
+			if strings.HasPrefix(s, addr+"~") {
+				return 4242 + (i*1000003)/len(order)
+			}
+		}
+		return testHash(s)
+	}
+	ch := New("/keys", "/key", "/key", "/key", hash, 1000003)
+	nodes := make(map[string]*testNode)
+	for i := 0; i < 3; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+
+	if err := ch.AddMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(200)
+	for _, key := range keys {
+		upload(t, ch, nodes, key)
+	}
+	for _, addr := range order[1:] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+		assertPlacement(t, ch, nodes, len(keys))
+	}
+
+	if pos := ch.Positions(order[0]); len(pos) != 1 || pos[0] != 4242 {
+		t.Errorf("expected the first member to keep its position, got %v", pos)
+	}
+	for _, addr := range order[1:] {
+		if pos := ch.Positions(addr); len(pos) != 1 || pos[0] == 4242 {
+			t.Errorf("expected %s to be moved off the taken position, got %v", addr, pos)
+		}
+		if len(nodes[addr].keys()) == 0 {
+			t.Errorf("expected colliding member %s to own keys", addr)
+		}
+	}
+
+	if err := ch.RemoveMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	delete(nodes, order[0])
+	assertPlacement(t, ch, nodes, len(keys))
+	if ch.Positions(order[0]) != nil {
+		t.Error("expected no positions for a removed member")
+	}
+}
+
+func TestConsistentHashing_HashSpace64(t *testing.T) {
+	hash64 := func(s string) uint64 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(s))
+		return mix64(h.Sum64())
+	}
+	ch := newTestConsistentHashing(WithHashSpace64(hash64), WithVirtualNodes(8))
+	nodes := make(map[string]*testNode)
+	var order []string
+	for i := 0; i < 3; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+
+	if err := ch.AddMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(200)
+	for _, key := range keys {
+		upload(t, ch, nodes, key)
+	}
+	for _, addr := range order[1:] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+		assertPlacement(t, ch, nodes, len(keys))
+	}
+
+	for _, addr := range order {
+		for vnode, pos := range ch.Positions(addr) {
+			if pos != hash64(vnodeKey(addr, vnode)) {
+				t.Errorf("expected %s vnode %d at its raw 64-bit hash, got %d", addr, vnode, pos)
+			}
+		}
+	}
+
+	if err := ch.RemoveMember(order[1]); err != nil {
+		t.Fatal(err)
+	}
+	delete(nodes, order[1])
+	assertPlacement(t, ch, nodes, len(keys))
+}
+
+func TestConsistentHashing_Epochs(t *testing.T) {
+	ch := newTestConsistentHashing()
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+
+	epoch, err := ch.CompareAndAddMember(0, a.addr(), 1)
+	if err != nil || epoch != 1 {
+		t.Fatalf("expected the first change to move to epoch 1, got %d %v", epoch, err)
+	}
+	if _, err := ch.CompareAndAddMember(0, b.addr(), 1); err != ErrStaleEpoch {
+		t.Errorf("expected a change against epoch 0 to be stale, got %v", err)
+	}
+	if epoch, err = ch.CompareAndAddMember(epoch, b.addr(), 1); err != nil || epoch != 2 {
+		t.Fatalf("expected epoch 2, got %d %v", epoch, err)
+	}
+	if err := ch.SetWeight(b.addr(), 2); err != nil || ch.Epoch() != 3 {
+		t.Errorf("expected changes without an epoch to bump it too, got %d %v", ch.Epoch(), err)
+	}
+	if _, err := ch.CompareAndSetWeight(epoch, b.addr(), 3); err != ErrStaleEpoch {
+		t.Errorf("expected setting a weight against epoch 2 to be stale, got %v", err)
+	}
+	if epoch, err = ch.CompareAndRemoveMember(3, b.addr()); err != nil || epoch != 4 {
+		t.Fatalf("expected epoch 4, got %d %v", epoch, err)
+	}
+
+	// a change that is rolled back still moves the epoch forward, past the one it was published under
+	a.srv.Close()
+	if err := ch.AddMember(c.addr()); err == nil {
+		t.Fatal("expected adding a member to fail while keys cannot be listed")
+	}
+	if ch.Epoch() != 6 || len(ch.Topology().Members) != 1 {
+		t.Errorf("expected the rollback to move to epoch 6 with a single member, got %d", ch.Epoch())
+	}
+}
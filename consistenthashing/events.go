@@ -0,0 +1,139 @@
+package consistenthashing
+
+import (
+	"sync"
+)
+
+// EventType tells what an Event reports
+type EventType int
+
+const (
+	// MemberAdded is emitted once a new member is part of the membership lookups see
+	MemberAdded EventType = iota
+	// MemberRemoved is emitted once a member is no longer part of the membership lookups see
+	MemberRemoved
+	// MemberWeightChanged is emitted once a member's new weight is part of the membership lookups see
+	MemberWeightChanged
+	// MigrationStarted follows every membership change, before any key moves
+	MigrationStarted
+	// KeyMoved is emitted for every key a member copied to new owners or dropped during a migration
+	KeyMoved
+	// MigrationFinished is emitted once every key moved to its new owners
+	MigrationFinished
+	// MigrationFailed is emitted when keys could not be moved, the previous membership is restored by then
+	MigrationFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MemberAdded:
+		return "member added"
+	case MemberRemoved:
+		return "member removed"
+	case MemberWeightChanged:
+		return "member weight changed"
+	case MigrationStarted:
+		return "migration started"
+	case KeyMoved:
+		return "key moved"
+	case MigrationFinished:
+		return "migration finished"
+	case MigrationFailed:
+		return "migration failed"
+	}
+	return "unknown"
+}
+
+// Event reports a change of the ring or of the keys on it, only the fields relevant to its Type are set
+type Event struct {
+	Type EventType
+	// Epoch is the epoch the cluster is at once the event happened
+	Epoch uint64
+	// Member is the member whose change caused every event but KeyMoved
+	Member string
+	// Weight is the member's new weight for MemberAdded and MemberWeightChanged
+	Weight int
+	// Key was copied From one member To others, and dropped from From when Dropped is set
+	Key     string
+	From    string
+	To      []string
+	Dropped bool
+	// Err is why a migration failed
+	Err error
+}
+
+// subscribers holds the callbacks events are delivered to
+type subscribers struct {
+	mu        sync.RWMutex
+	callbacks map[int]func(Event)
+	next      int
+}
+
+/*
+Subscribe calls fn with every event until the returned function is called. Events are delivered synchronously from the
+membership change emitting them, KeyMoved events concurrently from the goroutines moving keys, so fn has to be safe for
+concurrent use, return quickly and not change membership itself.
+*/
+func (ch *ConsistentHashing) Subscribe(fn func(Event)) func() {
+	ch.subscribers.mu.Lock()
+	defer ch.subscribers.mu.Unlock()
+	if ch.subscribers.callbacks == nil {
+		ch.subscribers.callbacks = make(map[int]func(Event))
+	}
+	id := ch.subscribers.next
+	ch.subscribers.next++
+	ch.subscribers.callbacks[id] = fn
+
+	return func() {
+		ch.subscribers.mu.Lock()
+		defer ch.subscribers.mu.Unlock()
+		delete(ch.subscribers.callbacks, id)
+	}
+}
+
+/*
+SubscribeChan delivers every event on a channel buffering up to buffer of them, until the returned function is called
+and the channel is closed. Membership changes never wait on a subscriber, events that do not fit in the buffer are
+dropped.
+*/
+func (ch *ConsistentHashing) SubscribeChan(buffer int) (<-chan Event, func()) {
+	events := make(chan Event, buffer)
+	var mu sync.Mutex
+	closed := false
+
+	unsubscribe := ch.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case events <- e:
+		default:
+		}
+	})
+
+	return events, func() {
+		unsubscribe()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(events)
+		}
+	}
+}
+
+// emit delivers e to every subscriber
+func (ch *ConsistentHashing) emit(e Event) {
+	ch.subscribers.mu.RLock()
+	callbacks := make([]func(Event), 0, len(ch.subscribers.callbacks))
+	for _, fn := range ch.subscribers.callbacks {
+		callbacks = append(callbacks, fn)
+	}
+	ch.subscribers.mu.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(e)
+	}
+}
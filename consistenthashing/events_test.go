@@ -0,0 +1,77 @@
+package consistenthashing
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConsistentHashing_Subscribe(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(8))
+	nodes := make(map[string]*testNode)
+	a, b := newTestNode(t), newTestNode(t)
+	nodes[a.addr()] = a
+
+	var mu sync.Mutex
+	var events []Event
+	unsubscribe := ch.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+
+	if err := ch.AddMember(a.addr()); err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(100)
+	for _, key := range keys {
+		upload(t, ch, nodes, key)
+	}
+	if err := ch.AddMember(b.addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []EventType{MemberAdded, MigrationStarted, MigrationFinished, MemberAdded, MigrationStarted}
+	for i, eventType := range expected {
+		if events[i].Type != eventType {
+			t.Fatalf("expected event %d to be %s, got %s", i, eventType, events[i].Type)
+		}
+	}
+	last := events[len(events)-1]
+	if last.Type != MigrationFinished || last.Epoch != 2 || last.Member != b.addr() {
+		t.Errorf("expected the migration to epoch 2 to finish last, got %+v", last)
+	}
+	moved := 0
+	for _, e := range events[len(expected) : len(events)-1] {
+		if e.Type != KeyMoved || e.From != a.addr() || len(e.To) != 1 || e.To[0] != b.addr() || !e.Dropped {
+			t.Errorf("expected keys to move from %s to %s, got %+v", a.addr(), b.addr(), e)
+		}
+		moved++
+	}
+	if moved != len(b.keys()) {
+		t.Errorf("expected %d key moved events, got %d", len(b.keys()), moved)
+	}
+
+	unsubscribe()
+	events = nil
+
+	changes, cancel := ch.SubscribeChan(16)
+	a.srv.Close()
+	if err := ch.RemoveMember(b.addr()); err == nil {
+		t.Fatal("expected removing a member to fail while keys cannot be listed")
+	}
+	cancel()
+
+	var received []Event
+	for e := range changes {
+		received = append(received, e)
+	}
+	if len(received) != 3 || received[0].Type != MemberRemoved || received[2].Type != MigrationFailed || received[2].Err == nil {
+		t.Fatalf("expected a removal followed by a failed migration, got %+v", received)
+	}
+	if received[2].Epoch != ch.Epoch() {
+		t.Errorf("expected the failed migration to report the epoch it rolled back to, got %d", received[2].Epoch)
+	}
+	if len(events) != 0 {
+		t.Error("expected no events after unsubscribing")
+	}
+}
@@ -0,0 +1,303 @@
+package consistenthashing
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+)
+
+/*
+Names of the hash functions shipped with the package, selectable from configuration through HashFunc and HashFunc64.
+
+Stability guarantee: the output of every named function is frozen. Placement on the ring is derived from these values,
+so changing one would silently remap keys after a proxy restart. hashes_test.go pins each of them to reference values,
+a different algorithm gets a new name instead of replacing an existing one.
+*/
+const (
+	// FNV1a32 is 32-bit FNV-1a, what main.go has always hashed with
+	FNV1a32 = "fnv1a32"
+	// FNV1a64 is 64-bit FNV-1a
+	FNV1a64 = "fnv1a64"
+	// Murmur3 is the first 64 bits (h1) of MurmurHash3 x64 128 with seed 0
+	Murmur3 = "murmur3"
+	// XXHash64 is XXH64 with seed 0
+	XXHash64 = "xxhash64"
+	// SipHash is SipHash-2-4 keyed with a 16 byte secret
+	SipHash = "siphash"
+	// CRC32 is the IEEE CRC-32 checksum
+	CRC32 = "crc32"
+	// SHA1 is the first 8 bytes of SHA-1, read big endian
+	SHA1 = "sha1"
+)
+
+type namedHash struct {
+	// wide is set for functions producing 64 bits, the others produce 32
+	wide  bool
+	build func(key []byte) (HashingFunc64, error)
+}
+
+func unkeyed(h HashingFunc64) func([]byte) (HashingFunc64, error) {
+	return func([]byte) (HashingFunc64, error) {
+		return h, nil
+	}
+}
+
+var hashCatalog = map[string]namedHash{
+	FNV1a32: {build: unkeyed(func(s string) uint64 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(s))
+		return uint64(h.Sum32())
+	})},
+	FNV1a64: {wide: true, build: unkeyed(func(s string) uint64 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(s))
+		return h.Sum64()
+	})},
+	Murmur3: {wide: true, build: unkeyed(func(s string) uint64 {
+		return murmur3x64(0, []byte(s))
+	})},
+	XXHash64: {wide: true, build: unkeyed(func(s string) uint64 {
+		return xxhash64(0, []byte(s))
+	})},
+	SipHash: {wide: true, build: func(key []byte) (HashingFunc64, error) {
+		if len(key) != 16 {
+			return nil, errors.New("siphash needs a 16 byte key")
+		}
+		k0, k1 := binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+		return func(s string) uint64 {
+			return sipHash24(k0, k1, []byte(s))
+		}, nil
+	}},
+	CRC32: {build: unkeyed(func(s string) uint64 {
+		return uint64(crc32.ChecksumIEEE([]byte(s)))
+	})},
+	SHA1: {wide: true, build: unkeyed(func(s string) uint64 {
+		sum := sha1.Sum([]byte(s))
+		return binary.BigEndian.Uint64(sum[:8])
+	})},
+}
+
+// HashNames lists the names accepted by HashFunc and HashFunc64
+func HashNames() []string {
+	names := make([]string, 0, len(hashCatalog))
+	for name := range hashCatalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashFunc64 returns the named hash function, key is only used by keyed functions like SipHash
+func HashFunc64(name string, key []byte) (HashingFunc64, error) {
+	named, ok := hashCatalog[name]
+	if !ok {
+		return nil, errors.New("unknown hash function " + name)
+	}
+	return named.build(key)
+}
+
+/*
+HashFunc returns the named hash function for rings reduced modulo a ring size. 32-bit functions are returned as is, so
+FNV1a32 matches the closure main.go used to build, 64-bit ones drop their top bit to stay non-negative.
+*/
+func HashFunc(name string, key []byte) (HashingFunc, error) {
+	h, err := HashFunc64(name, key)
+	if err != nil {
+		return nil, err
+	}
+	return func(s string) int {
+		return int(h(s) &^ (1 << 63))
+	}, nil
+}
+
+// murmur3x64 is the h1 half of MurmurHash3_x64_128
+func murmur3x64(seed uint64, data []byte) uint64 {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	h1, h2 := seed, seed
+	length := len(data)
+
+	for len(data) >= 16 {
+		k1 := binary.LittleEndian.Uint64(data)
+		k2 := binary.LittleEndian.Uint64(data[8:])
+		data = data[16:]
+
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := 8; i < len(data); i++ {
+		k2 ^= uint64(data[i]) << (uint(i-8) * 8)
+	}
+	if len(data) > 8 {
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+	}
+	for i := 0; i < len(data) && i < 8; i++ {
+		k1 ^= uint64(data[i]) << (uint(i) * 8)
+	}
+	if len(data) > 0 {
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(length)
+	h2 ^= uint64(length)
+	h1 += h2
+	h2 += h1
+	h1 = murmurFmix64(h1)
+	h2 = murmurFmix64(h2)
+	h1 += h2
+	return h1
+}
+
+func murmurFmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is XXH64
+func xxhash64(seed uint64, data []byte) uint64 {
+	length := len(data)
+	var h uint64
+
+	if length >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(length)
+
+	for len(data) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc uint64, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// sipHash24 is SipHash-2-4 with the key split into two little endian words
+func sipHash24(k0 uint64, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for len(data) >= 8 {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		data = data[8:]
+	}
+
+	last := uint64(length) << 56
+	for i, b := range data {
+		last |= uint64(b) << (uint(i) * 8)
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
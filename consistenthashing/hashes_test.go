@@ -0,0 +1,91 @@
+package consistenthashing
+
+import (
+	"testing"
+)
+
+// These values pin the output of every named hash function, see the stability guarantee in hashes.go. A failure here
+// means keys would be remapped after upgrading, so fix the implementation rather than the expected value.
+func TestHashes_ReferenceValues(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  uint64
+	}{
+		{FNV1a32, "", 0x811c9dc5},
+		{FNV1a32, "a", 0xe40c292c},
+		{FNV1a64, "", 0xcbf29ce484222325},
+		{FNV1a64, "a", 0xaf63dc4c8601ec8c},
+		{Murmur3, "", 0},
+		{Murmur3, "hello", 0xcbd8a7b341bd9b02},
+		{Murmur3, "The quick brown fox jumps over the lazy dog", 0xe34bbc7bbc071b6c},
+		{XXHash64, "", 0xef46db3751d8e999},
+		{XXHash64, "a", 0xd24ec4f1a98c6e5b},
+		{XXHash64, "asdf", 0x415872f599cea71e},
+		{XXHash64, "Call me Ishmael. Some years ago--never mind how long precisely-", 0x02a2e85470d6fd96},
+		{CRC32, "123456789", 0xcbf43926},
+		{SHA1, "abc", 0xa9993e364706816a},
+	}
+	for _, c := range cases {
+		h, err := HashFunc64(c.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h(c.input); got != c.want {
+			t.Errorf("%s(%q) = %#x, want %#x", c.name, c.input, got, c.want)
+		}
+	}
+}
+
+func TestHashes_SipHash(t *testing.T) {
+	key := make([]byte, 16)
+	msg := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	h, err := HashFunc64(SipHash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reference vectors from the SipHash paper
+	if got := h(""); got != 0x726fdb47dd0e0e31 {
+		t.Errorf("siphash of the empty message = %#x", got)
+	}
+	if got := h(string(msg)); got != 0xa129ca6149be45e5 {
+		t.Errorf("siphash of 15 bytes = %#x", got)
+	}
+
+	if _, err := HashFunc64(SipHash, []byte("short")); err == nil {
+		t.Error("expected siphash to require a 16 byte key")
+	}
+}
+
+func TestHashes_HashFunc(t *testing.T) {
+	if _, err := HashFunc("md5", nil); err == nil {
+		t.Error("expected an unknown hash function to be rejected")
+	}
+	for _, name := range HashNames() {
+		var key []byte
+		if name == SipHash {
+			key = []byte("0123456789abcdef")
+		}
+		h, err := HashFunc(name, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range testKeys(100) {
+			if h(input) < 0 {
+				t.Errorf("%s(%q) is negative", name, input)
+			}
+		}
+	}
+
+	fnv32, _ := HashFunc(FNV1a32, nil)
+	if fnv32("a") != 0xe40c292c {
+		t.Error("expected the 32-bit FNV-1a to keep its full value")
+	}
+}
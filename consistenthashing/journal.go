@@ -0,0 +1,363 @@
+package consistenthashing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// WithJournal records every migration in a journal at path, so that Recover can finish or undo one the proxy did not
+// live to complete
+func WithJournal(path string) Option {
+	return func(ch *ConsistentHashing) {
+		ch.journal = &journal{path: path}
+	}
+}
+
+// Journal record types, in the order a migration writes them
+const (
+	journalBegin    = "begin"
+	journalPlan     = "plan"
+	journalWritten  = "written"
+	journalCopied   = "copied"
+	journalFailed   = "failed"
+	journalCopyDone = "copy-done"
+	journalDeleted  = "deleted"
+	journalCommit   = "commit"
+	journalAbort    = "abort"
+)
+
+/*
+MemberState is what it takes to place a member again exactly where it was. Positions are its virtual nodes on the ring,
+Buckets the jump buckets it owns, which depend on the order members were added and removed in.
+*/
+type MemberState struct {
+	Address   string   `json:"address"`
+	Weight    int      `json:"weight"`
+	Positions []uint64 `json:"positions,omitempty"`
+	Buckets   []int    `json:"buckets,omitempty"`
+}
+
+// journalRecord is a line of the journal, only the fields relevant to its Type are set
+type journalRecord struct {
+	Type string `json:"type"`
+	// Epoch, Member, Previous and Next describe the membership change a begin record starts
+	Epoch    uint64        `json:"epoch,omitempty"`
+	Member   string        `json:"member,omitempty"`
+	Previous []MemberState `json:"previous,omitempty"`
+	Next     []MemberState `json:"next,omitempty"`
+	// Key moves From one member To others, and is dropped from From when Drop is set
+	Key  string   `json:"key,omitempty"`
+	From string   `json:"from,omitempty"`
+	To   []string `json:"to,omitempty"`
+	Drop bool     `json:"drop,omitempty"`
+	// Owners and PreviousOwners are where a key written during the migration went to, and where it was before
+	Owners         []string `json:"owners,omitempty"`
+	PreviousOwners []string `json:"previousOwners,omitempty"`
+}
+
+/*
+journal appends the progress of the current migration to a file, one JSON record per line. Every record is written to
+the file as soon as it happens, which is enough to survive the proxy crashing, and the file is synced to disk at every
+phase boundary. A new migration truncates the journal, which only ever holds the latest one.
+*/
+type journal struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// begin starts journaling a migration, refusing to while the journal still holds one that was interrupted
+func (j *journal) begin(record journalRecord) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records, err := readJournal(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if interrupted(records) {
+		return errors.New("the journal holds an interrupted migration, recover it first")
+	}
+
+	j.file, err = os.Create(j.path)
+	if err != nil {
+		return err
+	}
+	return j.write(record, true)
+}
+
+// append adds record to the journal of the current migration, syncing it to disk when sync is set
+func (j *journal) append(record journalRecord, sync bool) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	if err := j.write(record, sync); err != nil {
+		log.Printf("Could not journal %s record: %v \n", record.Type, err)
+	}
+}
+
+// finish ends the current migration with a commit or abort record
+func (j *journal) finish(recordType string) {
+	if j == nil {
+		return
+	}
+	j.append(journalRecord{Type: recordType}, true)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+}
+
+func (j *journal) write(record journalRecord, sync bool) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// readJournal reads every complete record, a last line cut short by a crash is ignored
+func readJournal(path string) ([]journalRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []journalRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// interrupted reports whether records start a migration without finishing it
+func interrupted(records []journalRecord) bool {
+	if len(records) == 0 || records[0].Type != journalBegin {
+		return false
+	}
+	last := records[len(records)-1].Type
+	return last != journalCommit && last != journalAbort
+}
+
+// Recovery reports what Recover found in the journal
+type Recovery struct {
+	// Interrupted is set when the journal ended in the middle of a migration
+	Interrupted bool
+	// RolledBack is set when the interrupted migration was undone rather than finished
+	RolledBack bool
+	// Member is the member whose change was interrupted, Epoch the epoch the cluster is at after recovering
+	Member string
+	Epoch  uint64
+}
+
+/*
+Recover finishes or undoes a migration the journal shows was interrupted, and makes the membership it ends up with the
+one lookups see. It has to run before the proxy serves requests. A migration that had not copied every key yet is rolled
+back: copies are deleted from the new owners, and keys written in the meantime are moved back to their previous owners.
+One that was already dropping keys has the drops that are left finished. Recover can be called again when it fails,
+every step is safe to repeat.
+*/
+func (ch *ConsistentHashing) Recover() (*Recovery, error) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	if ch.journal == nil {
+		return &Recovery{}, nil
+	}
+	records, err := readJournal(ch.journal.path)
+	if os.IsNotExist(err) {
+		return &Recovery{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !interrupted(records) {
+		return &Recovery{}, nil
+	}
+
+	begin := records[0]
+	written := make(map[string]journalRecord)
+	done := make(map[[2]string]bool)
+	var plan []journalRecord
+	copyDone := false
+	for _, record := range records[1:] {
+		switch record.Type {
+		case journalPlan:
+			plan = append(plan, record)
+		case journalWritten:
+			written[record.Key] = record
+		case journalFailed, journalDeleted:
+			done[[2]string{record.Key, record.From}] = true
+		case journalCopyDone:
+			copyDone = true
+		}
+	}
+
+	recovery := &Recovery{Interrupted: true, Member: begin.Member}
+	var failures []KeyError
+	var states []MemberState
+	if copyDone {
+		log.Printf("Finishing the interrupted migration to epoch %d \n", begin.Epoch)
+		for _, task := range plan {
+			if !task.Drop || done[[2]string{task.Key, task.From}] {
+				continue
+			}
+			if err := ch.retry(func() error {
+				return ch.transferer.Delete(task.From, task.Key)
+			}); err != nil {
+				failures = append(failures, KeyError{Key: task.Key, Member: task.From, Op: OpDelete, Err: err})
+			}
+		}
+		states, recovery.Epoch = begin.Next, begin.Epoch
+	} else {
+		log.Printf("Rolling back the interrupted migration to epoch %d \n", begin.Epoch)
+		for _, record := range written {
+			ch.restoreWrite(record.Key, record.PreviousOwners, record.Owners)
+		}
+		for _, task := range plan {
+			if _, ok := written[task.Key]; ok {
+				continue
+			}
+			for _, to := range task.To {
+				if err := ch.retry(func() error {
+					return ch.transferer.Delete(to, task.Key)
+				}); err != nil {
+					failures = append(failures, KeyError{Key: task.Key, Member: to, Op: OpDelete, Err: err})
+				}
+			}
+		}
+		states, recovery.Epoch, recovery.RolledBack = begin.Previous, begin.Epoch+1, true
+	}
+
+	v, err := ch.restoreView(states, recovery.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	ch.writeMu.Lock()
+	ch.loadMu.Lock()
+	ch.current.Store(v)
+	if ch.capacityFactor > 0 {
+		ch.assignments = make(map[string][]string)
+		ch.loads = make(map[string]int)
+	}
+	ch.loadMu.Unlock()
+	ch.writeMu.Unlock()
+	ch.saveState()
+
+	if len(failures) > 0 {
+		return recovery, &MigrationError{RolledBack: recovery.RolledBack, Failures: failures}
+	}
+
+	// the journal is only reopened for appending to mark the migration as recovered
+	ch.journal.mu.Lock()
+	ch.journal.file, err = os.OpenFile(ch.journal.path, os.O_WRONLY|os.O_APPEND, 0644)
+	ch.journal.mu.Unlock()
+	if err != nil {
+		return recovery, err
+	}
+	if recovery.RolledBack {
+		ch.journal.finish(journalAbort)
+	} else {
+		ch.journal.finish(journalCommit)
+	}
+	return recovery, nil
+}
+
+// memberStates captures every member of v so that restoreView can place it again
+func memberStates(v *view) []MemberState {
+	r, isRing := v.placement.(*ring)
+	j, isJump := v.placement.(*jump)
+	states := make([]MemberState, 0, len(v.weights))
+	for _, member := range sortedMembers(v.weights) {
+		state := MemberState{Address: member, Weight: v.weights[member]}
+		if isRing {
+			state.Positions = r.positions(member)
+		}
+		if isJump {
+			state.Buckets = j.bucketsOf(member)
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+/*
+restoreView places members on an empty copy of the configured placement, the ring at exactly the recorded positions and
+jump in exactly the recorded bucket order. Adding them again would place them by address instead.
+*/
+func (ch *ConsistentHashing) restoreView(states []MemberState, epoch uint64) (*view, error) {
+	v := &view{placement: ch.partitioner, weights: make(map[string]int), epoch: epoch}
+	if j, ok := ch.partitioner.(*jump); ok {
+		buckets, err := jumpBuckets(states)
+		if err != nil {
+			return nil, err
+		}
+		v.placement = j.withBuckets(buckets)
+		for _, state := range states {
+			v.weights[state.Address] = state.Weight
+		}
+		return v, nil
+	}
+	for _, state := range states {
+		if r, ok := v.placement.(*ring); ok && len(state.Positions) > 0 {
+			v.placement = r.withPositions(state.Address, state.Positions)
+		} else {
+			placement, err := v.placement.Add(state.Address, state.Weight)
+			if err != nil {
+				return nil, err
+			}
+			v.placement = placement
+		}
+		v.weights[state.Address] = state.Weight
+	}
+	return v, nil
+}
+
+// jumpBuckets puts every member back into the buckets it owned, which have to account for its weight and each other
+func jumpBuckets(states []MemberState) ([]string, error) {
+	total := 0
+	for _, state := range states {
+		total += state.Weight
+	}
+	buckets := make([]string, total)
+	for _, state := range states {
+		if len(state.Buckets) != state.Weight {
+			return nil, fmt.Errorf("%d buckets recorded for %s of weight %d", len(state.Buckets), state.Address, state.Weight)
+		}
+		for _, idx := range state.Buckets {
+			if idx < 0 || idx >= total || buckets[idx] != "" {
+				return nil, fmt.Errorf("bucket %d of %s is out of range or taken", idx, state.Address)
+			}
+			buckets[idx] = state.Address
+		}
+	}
+	return buckets, nil
+}
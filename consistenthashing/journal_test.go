@@ -0,0 +1,165 @@
+package consistenthashing
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// crashingTransferer stops answering once op was called after times calls, as if the proxy died mid-migration
+type crashingTransferer struct {
+	*MemoryTransferer
+	mu      sync.Mutex
+	op      string
+	times   int
+	dead    bool
+	crashed chan struct{}
+}
+
+func newCrashingTransferer(memory *MemoryTransferer, op string, times int) *crashingTransferer {
+	return &crashingTransferer{MemoryTransferer: memory, op: op, times: times, crashed: make(chan struct{})}
+}
+
+// check blocks forever once the transferer is dead, a crashed proxy never gets to run another step
+func (t *crashingTransferer) check(op string) {
+	t.mu.Lock()
+	if !t.dead && op == t.op {
+		t.times--
+		if t.times < 0 {
+			t.dead = true
+			close(t.crashed)
+		}
+	}
+	dead := t.dead
+	t.mu.Unlock()
+	if dead {
+		select {}
+	}
+}
+
+func (t *crashingTransferer) ListKeys(member string) ([]string, error) {
+	t.check(OpList)
+	return t.MemoryTransferer.ListKeys(member)
+}
+
+func (t *crashingTransferer) Fetch(member string, key string) ([]byte, error) {
+	t.check(OpFetch)
+	return t.MemoryTransferer.Fetch(member, key)
+}
+
+func (t *crashingTransferer) Store(member string, key string, value []byte) error {
+	t.check(OpStore)
+	return t.MemoryTransferer.Store(member, key, value)
+}
+
+func (t *crashingTransferer) Delete(member string, key string) error {
+	t.check(OpDelete)
+	return t.MemoryTransferer.Delete(member, key)
+}
+
+// crashDuringAdd adds node-b:1 to a single member cluster holding keys until transferer crashes, then returns a fresh
+// instance over the same journal and nodes, as a restarted proxy would have
+func crashDuringAdd(t *testing.T, memory *MemoryTransferer, transferer *crashingTransferer, keys []string, beforeCrash func(ch *ConsistentHashing)) *ConsistentHashing {
+	path := filepath.Join(t.TempDir(), "journal")
+	opts := []Option{WithVirtualNodes(8), WithJournal(path), WithRetries(1, 0)}
+
+	ch := newTestConsistentHashing(append(opts, WithTransferer(transferer))...)
+	if err := ch.AddMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		_ = memory.Store("node-a:1", key, []byte("val-"+key))
+	}
+	if beforeCrash != nil {
+		beforeCrash(ch)
+	}
+
+	go func() {
+		_ = ch.AddMember("node-b:1")
+	}()
+	select {
+	case <-transferer.crashed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the migration to crash")
+	}
+
+	restarted := newTestConsistentHashing(append(opts, WithTransferer(memory))...)
+	if err := restarted.AddMember("node-c:1"); err == nil {
+		t.Error("expected changing membership to wait for the interrupted migration to be recovered")
+	}
+	return restarted
+}
+
+func TestConsistentHashing_RecoverRollsBackInterruptedCopies(t *testing.T) {
+	memory := NewMemoryTransferer()
+	keys := testKeys(200)
+	var written string
+	restarted := crashDuringAdd(t, memory, newCrashingTransferer(memory, OpStore, 10), keys, func(ch *ConsistentHashing) {
+		// write a key owned by the new member before the crash, it only reaches the new member
+		ch.Subscribe(func(e Event) {
+			if e.Type != MigrationStarted {
+				return
+			}
+			for _, key := range keys {
+				route, done, _ := ch.BeginWrite(key)
+				if route.Shards[0] == "node-b:1" {
+					_ = memory.Store("node-b:1", key, []byte("new"))
+					written = key
+					done()
+					return
+				}
+				done()
+			}
+		})
+	})
+
+	recovery, err := restarted.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovery.Interrupted || !recovery.RolledBack || recovery.Epoch != 3 || recovery.Member != "node-b:1" {
+		t.Errorf("unexpected recovery %+v", recovery)
+	}
+	if topology := restarted.Topology(); len(topology.Members) != 1 || topology.Epoch != 3 {
+		t.Errorf("expected the previous membership at epoch 3, got %+v", topology)
+	}
+	if len(memory.Keys("node-b:1")) != 0 {
+		t.Errorf("expected the copies on the new member to be removed, %d are left", len(memory.Keys("node-b:1")))
+	}
+	if len(memory.Keys("node-a:1")) != len(keys) || string(memory.Keys("node-a:1")[written]) != "new" {
+		t.Error("expected the previous owner to hold every key, including the one written during the migration")
+	}
+
+	if recovery, err = restarted.Recover(); err != nil || recovery.Interrupted {
+		t.Errorf("expected nothing left to recover, got %+v %v", recovery, err)
+	}
+	if err := restarted.AddMember("node-c:1"); err != nil {
+		t.Errorf("expected membership changes to work again once recovered, got %v", err)
+	}
+}
+
+func TestConsistentHashing_RecoverFinishesInterruptedDrops(t *testing.T) {
+	memory := NewMemoryTransferer()
+	keys := testKeys(200)
+	restarted := crashDuringAdd(t, memory, newCrashingTransferer(memory, OpDelete, 10), keys, nil)
+
+	recovery, err := restarted.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovery.Interrupted || recovery.RolledBack || recovery.Epoch != 2 {
+		t.Errorf("unexpected recovery %+v", recovery)
+	}
+	for _, key := range keys {
+		shard, err := restarted.GetShard(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range []string{"node-a:1", "node-b:1"} {
+			if _, ok := memory.Keys(member)[key]; ok != (member == shard) {
+				t.Errorf("expected %s only on %s", key, shard)
+			}
+		}
+	}
+}
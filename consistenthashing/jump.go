@@ -0,0 +1,123 @@
+package consistenthashing
+
+import "fmt"
+
+/*
+jump is Lamping and Veach's jump consistent hash. Members own weight buckets each, and buckets can only be appended or
+removed at the end without remapping keys, so removing a member refills its buckets with the ones at the tail.
+*/
+type jump struct {
+	hashFunc HashingFunc
+	buckets  []string
+}
+
+func (j *jump) Name() string {
+	return JumpPartitioner
+}
+
+// Locate rehashes the key with an increasing salt until it has found n distinct members
+func (j *jump) Locate(key string, n int) []string {
+	if len(j.buckets) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var owners []string
+	for salt := 0; salt < 8*len(j.buckets) && len(owners) < n; salt++ {
+		saltedKey := key
+		if salt > 0 {
+			saltedKey = fmt.Sprintf("%s#%d", key, salt)
+		}
+		member := j.buckets[jumpHash(mix64(uint64(j.hashFunc(saltedKey))), len(j.buckets))]
+		if !seen[member] {
+			seen[member] = true
+			owners = append(owners, member)
+		}
+	}
+	// fall back to bucket order for whatever the salted lookups could not reach
+	for _, member := range j.buckets {
+		if len(owners) >= n {
+			break
+		}
+		if !seen[member] {
+			seen[member] = true
+			owners = append(owners, member)
+		}
+	}
+	return owners
+}
+
+func (j *jump) Add(member string, weight int) (Partitioner, error) {
+	next := &jump{hashFunc: j.hashFunc, buckets: append([]string(nil), j.buckets...)}
+	current := 0
+	for _, bucket := range next.buckets {
+		if bucket == member {
+			current++
+		}
+	}
+	for ; current < weight; current++ {
+		next.buckets = append(next.buckets, member)
+	}
+	for ; current > weight; current-- {
+		next.removeBucket(member)
+	}
+	return next, nil
+}
+
+func (j *jump) Remove(member string) Partitioner {
+	next := &jump{hashFunc: j.hashFunc, buckets: append([]string(nil), j.buckets...)}
+	for next.removeBucket(member) {
+	}
+	return next
+}
+
+func (j *jump) Members() []string {
+	seen := make(map[string]bool)
+	var members []string
+	for _, bucket := range j.buckets {
+		if !seen[bucket] {
+			seen[bucket] = true
+			members = append(members, bucket)
+		}
+	}
+	return members
+}
+
+// bucketsOf lists the buckets member owns, their order is what restoring a jump placement has to get back
+func (j *jump) bucketsOf(member string) []int {
+	var buckets []int
+	for idx, bucket := range j.buckets {
+		if bucket == member {
+			buckets = append(buckets, idx)
+		}
+	}
+	return buckets
+}
+
+// withBuckets returns a placement with exactly buckets, in that order
+func (j *jump) withBuckets(buckets []string) *jump {
+	return &jump{hashFunc: j.hashFunc, buckets: append([]string(nil), buckets...)}
+}
+
+// removeBucket drops the last bucket of member by moving the tail bucket into its slot
+func (j *jump) removeBucket(member string) bool {
+	for idx := len(j.buckets) - 1; idx >= 0; idx-- {
+		if j.buckets[idx] == member {
+			last := len(j.buckets) - 1
+			j.buckets[idx] = j.buckets[last]
+			j.buckets = j.buckets[:last]
+			return true
+		}
+	}
+	return false
+}
+
+// jumpHash maps key onto one of numBuckets buckets, see https://arxiv.org/abs/1406.2294
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,96 @@
+package consistenthashing
+
+// maglevTableSize is the number of lookup table slots, it has to be prime for every skip to visit every slot
+const maglevTableSize = 65537
+
+/*
+maglev is Google's Maglev hashing: members take turns filling a lookup table following their own permutation of the
+slots, and a key belongs to the member in the slot it hashes to. Members get weight turns per round.
+*/
+type maglev struct {
+	hashFunc HashingFunc
+	weights  map[string]int
+	members  []string
+	// table holds an index into members for every slot
+	table []int
+}
+
+func newMaglev(hashFunc HashingFunc, weights map[string]int) *maglev {
+	m := &maglev{hashFunc: hashFunc, weights: weights, members: sortedMembers(weights)}
+	m.populate()
+	return m
+}
+
+func (m *maglev) Name() string {
+	return MaglevPartitioner
+}
+
+// Locate walks the lookup table from the key's slot collecting distinct members
+func (m *maglev) Locate(key string, n int) []string {
+	if len(m.members) == 0 {
+		return nil
+	}
+	start := int(mix64(uint64(m.hashFunc(key))) % maglevTableSize)
+	seen := make(map[int]bool)
+	var owners []string
+	for i := 0; i < maglevTableSize && len(owners) < n && len(owners) < len(m.members); i++ {
+		member := m.table[(start+i)%maglevTableSize]
+		if !seen[member] {
+			seen[member] = true
+			owners = append(owners, m.members[member])
+		}
+	}
+	return owners
+}
+
+func (m *maglev) Add(member string, weight int) (Partitioner, error) {
+	weights := copyWeights(m.weights)
+	weights[member] = weight
+	return newMaglev(m.hashFunc, weights), nil
+}
+
+func (m *maglev) Remove(member string) Partitioner {
+	weights := copyWeights(m.weights)
+	delete(weights, member)
+	return newMaglev(m.hashFunc, weights)
+}
+
+func (m *maglev) Members() []string {
+	return append([]string(nil), m.members...)
+}
+
+func (m *maglev) populate() {
+	if len(m.members) == 0 {
+		return
+	}
+	offsets := make([]uint64, len(m.members))
+	skips := make([]uint64, len(m.members))
+	next := make([]uint64, len(m.members))
+	for i, member := range m.members {
+		offsets[i] = mix64(uint64(m.hashFunc(member+"#offset"))) % maglevTableSize
+		skips[i] = mix64(uint64(m.hashFunc(member+"#skip")))%(maglevTableSize-1) + 1
+	}
+
+	m.table = make([]int, maglevTableSize)
+	for slot := range m.table {
+		m.table[slot] = -1
+	}
+	filled := 0
+	for {
+		for i, member := range m.members {
+			for turn := 0; turn < m.weights[member]; turn++ {
+				slot := (offsets[i] + next[i]*skips[i]) % maglevTableSize
+				for m.table[slot] >= 0 {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % maglevTableSize
+				}
+				m.table[slot] = i
+				next[i]++
+				filled++
+				if filled == maglevTableSize {
+					return
+				}
+			}
+		}
+	}
+}
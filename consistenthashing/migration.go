@@ -0,0 +1,219 @@
+package consistenthashing
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailurePolicy decides what a membership change does when keys cannot be moved to their new owners
+type FailurePolicy int
+
+const (
+	// AbortOnFailure restores the previous membership when any key could not be listed or copied, the default
+	AbortOnFailure FailurePolicy = iota
+	// ContinueOnFailure keeps the new membership, leaves keys that could not be copied where they were and reports them
+	ContinueOnFailure
+)
+
+// WithFailurePolicy picks what a membership change does when keys cannot be moved
+func WithFailurePolicy(p FailurePolicy) Option {
+	return func(ch *ConsistentHashing) {
+		ch.failurePolicy = p
+	}
+}
+
+// WithRetries makes up to attempts tries at every step of moving a key, waiting backoff before the first retry and
+// twice as long before every next one. The default is 3 attempts starting from 100ms.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(ch *ConsistentHashing) {
+		if attempts > 0 {
+			ch.attempts = attempts
+		}
+		ch.backoff = backoff
+	}
+}
+
+// Steps of moving a key a KeyError can report
+const (
+	OpList   = "list"
+	OpFetch  = "fetch"
+	OpStore  = "store"
+	OpDelete = "delete"
+)
+
+// KeyError is a step of moving a key that still failed after every retry, Key is empty when listing keys failed
+type KeyError struct {
+	Key    string
+	Member string
+	Op     string
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s on %s: %v", e.Op, e.Member, e.Err)
+	}
+	return fmt.Sprintf("%s of key %s on %s: %v", e.Op, e.Key, e.Member, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// MigrationError reports every step a membership change could not complete
+type MigrationError struct {
+	// RolledBack is set when the previous membership was restored
+	RolledBack bool
+	Failures   []KeyError
+}
+
+func (e *MigrationError) Error() string {
+	outcome := "kept the new membership"
+	if e.RolledBack {
+		outcome = "rolled back"
+	}
+	return fmt.Sprintf("migration %s after %d failed steps, first %s", outcome, len(e.Failures), e.Failures[0].Error())
+}
+
+// Route tells the proxy where a key lives while membership may be changing
+type Route struct {
+	// Shards is the preference list of the key under the current membership, reads and writes go here
+	Shards []string
+	// Fallback is the preference list under the previous membership while the key may not have moved yet, reads that
+	// miss on Shards retry here. It is empty when no migration is in flight or the key has been written since.
+	Fallback []string
+	// Epoch is the epoch of the membership the key was looked up in
+	Epoch uint64
+}
+
+/*
+migration tracks a membership change whose keys are still moving. Writes made while it is in flight already go to the
+new owners, so it remembers those keys to keep redistribute from overwriting them with the copy it took earlier.
+*/
+type migration struct {
+	previous            *view
+	previousAssignments map[string][]string
+
+	mu      sync.Mutex
+	copied  *sync.Cond
+	written map[string]bool
+	copying map[string]int
+}
+
+func newMigration(previous *view, previousAssignments map[string][]string) *migration {
+	m := &migration{
+		previous:            previous,
+		previousAssignments: previousAssignments,
+		written:             make(map[string]bool),
+		copying:             make(map[string]int),
+	}
+	m.copied = sync.NewCond(&m.mu)
+	return m
+}
+
+// recordWrite marks key as written and waits for a copy of it that is already under way, so the write lands after it.
+// It reports whether this is the first write to key since the migration started.
+func (m *migration) recordWrite(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	first := !m.written[key]
+	m.written[key] = true
+	for m.copying[key] > 0 {
+		m.copied.Wait()
+	}
+	return first
+}
+
+// writtenKeys lists every key written since the migration started
+func (m *migration) writtenKeys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.written))
+	for key := range m.written {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *migration) wasWritten(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.written[key]
+}
+
+// beginCopy reports whether key may still be copied, writes to it wait until the matching endCopy
+func (m *migration) beginCopy(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.written[key] {
+		return false
+	}
+	m.copying[key]++
+	return true
+}
+
+func (m *migration) endCopy(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copying[key]--
+	if m.copying[key] == 0 {
+		delete(m.copying, key)
+	}
+	m.copied.Broadcast()
+}
+
+// Route looks up shardKey for a read, including where to fall back to while a migration may not have moved it yet
+func (ch *ConsistentHashing) Route(shardKey string) (*Route, error) {
+	v := ch.current.Load()
+	shards, err := ch.lookup(v, shardKey)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &Route{Shards: shards, Epoch: v.epoch}
+	if m := v.migration; m != nil && !m.wasWritten(shardKey) {
+		previous := ch.previousOwners(m.previous, m.previousAssignments, shardKey)
+		if !sameOwners(previous, shards) {
+			route.Fallback = previous
+		}
+	}
+	return route, nil
+}
+
+/*
+BeginWrite looks up shardKey for a write or delete. A migration in flight will no longer copy the key over its new
+owners, and membership changes wait until the returned function is called, which has to happen once the write has been
+forwarded.
+*/
+func (ch *ConsistentHashing) BeginWrite(shardKey string) (*Route, func(), error) {
+	ch.writeMu.RLock()
+	v := ch.current.Load()
+	shards, err := ch.lookup(v, shardKey)
+	if err != nil {
+		ch.writeMu.RUnlock()
+		return nil, nil, err
+	}
+	if v.migration != nil && v.migration.recordWrite(shardKey) {
+		// journaled before the write is forwarded, so recovering from a crash can move it back when rolling back
+		ch.journal.append(journalRecord{
+			Type:           journalWritten,
+			Key:            shardKey,
+			Owners:         shards,
+			PreviousOwners: ch.previousOwners(v.migration.previous, v.migration.previousAssignments, shardKey),
+		}, false)
+	}
+	return &Route{Shards: shards, Epoch: v.epoch}, ch.writeMu.RUnlock, nil
+}
+
+func sameOwners(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package consistenthashing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newMemoryCluster starts a cluster of a single member holding keys, moving data through a MemoryTransferer
+func newMemoryCluster(t *testing.T, keys []string, opts ...Option) (*ConsistentHashing, *MemoryTransferer) {
+	transferer := NewMemoryTransferer()
+	opts = append(opts, WithVirtualNodes(8), WithTransferer(transferer), WithRetries(3, time.Millisecond))
+	ch := newTestConsistentHashing(opts...)
+	if err := ch.AddMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		_ = transferer.Store("node-a:1", key, []byte("val-"+key))
+	}
+	return ch, transferer
+}
+
+func TestConsistentHashing_MigrationAbortsAndRollsBack(t *testing.T) {
+	keys := testKeys(100)
+	ch, transferer := newMemoryCluster(t, keys)
+	transferer.Fail("node-b:1", OpStore, -1)
+
+	err := ch.AddMember("node-b:1")
+	var migrationErr *MigrationError
+	if !errors.As(err, &migrationErr) || !migrationErr.RolledBack || len(migrationErr.Failures) == 0 {
+		t.Fatalf("expected a rolled back migration, got %v", err)
+	}
+	for _, failure := range migrationErr.Failures {
+		if failure.Op != OpStore || failure.Member != "node-b:1" || !errors.Is(&failure, ErrInjectedFailure) {
+			t.Errorf("unexpected failure %v", &failure)
+		}
+	}
+	if len(ch.Topology().Members) != 1 || len(transferer.Keys("node-a:1")) != len(keys) {
+		t.Error("expected the previous membership to keep every key")
+	}
+
+	// copies that landed before the abort are removed again
+	transferer.Fail("node-b:1", OpStore, 0)
+	transferer.Fail("node-c:1", OpStore, -1)
+	if err := ch.AddMember("node-c:1"); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if len(transferer.Keys("node-c:1")) != 0 || len(transferer.Keys("node-a:1")) != len(keys) {
+		t.Error("expected an aborted migration to leave no copies behind")
+	}
+}
+
+func TestConsistentHashing_MigrationContinuesAndReports(t *testing.T) {
+	keys := testKeys(100)
+	ch, transferer := newMemoryCluster(t, keys, WithFailurePolicy(ContinueOnFailure))
+	transferer.Fail("node-a:1", OpFetch, -1)
+
+	err := ch.AddMember("node-b:1")
+	var migrationErr *MigrationError
+	if !errors.As(err, &migrationErr) || migrationErr.RolledBack {
+		t.Fatalf("expected a migration that kept the new membership, got %v", err)
+	}
+	if len(ch.Topology().Members) != 2 {
+		t.Error("expected the new member to stay")
+	}
+	if len(migrationErr.Failures) != Balance(ch.current.Load().placement, keys)["node-b:1"] {
+		t.Errorf("expected a failure per key owned by the new member, got %d", len(migrationErr.Failures))
+	}
+	if len(transferer.Keys("node-a:1")) != len(keys) {
+		t.Error("expected keys that could not be copied to stay where they were")
+	}
+}
+
+func TestConsistentHashing_RemoveMemberWithPolicy(t *testing.T) {
+	ch, transferer := newMemoryCluster(t, testKeys(20))
+	if err := ch.AddMember("node-b:1"); err != nil {
+		t.Fatal(err)
+	}
+	transferer.Fail("node-a:1", OpList, -1)
+
+	if err := ch.RemoveMember("node-a:1"); err == nil || len(ch.Topology().Members) != 2 {
+		t.Fatalf("expected the configured policy to roll the removal back, got %v", err)
+	}
+	var migrationErr *MigrationError
+	if err := ch.RemoveMemberWithPolicy("node-a:1", ContinueOnFailure); !errors.As(err, &migrationErr) || migrationErr.RolledBack {
+		t.Fatalf("expected the removal to go through and report the keys it left behind, got %v", err)
+	}
+	if members := ch.Topology().Members; len(members) != 1 || members[0].Address != "node-b:1" {
+		t.Errorf("expected only node-b:1 to be left, got %+v", members)
+	}
+}
+
+func TestConsistentHashing_MigrationRetries(t *testing.T) {
+	keys := testKeys(100)
+	ch, transferer := newMemoryCluster(t, keys)
+	transferer.Fail("node-a:1", OpList, 2)
+	transferer.Fail("node-b:1", OpStore, 2)
+	transferer.Fail("node-a:1", OpDelete, 2)
+
+	if err := ch.AddMember("node-b:1"); err != nil {
+		t.Fatalf("expected retries to get past transient failures, got %v", err)
+	}
+	for _, key := range keys {
+		shard, _ := ch.GetShard(key)
+		if _, ok := transferer.Keys(shard)[key]; !ok {
+			t.Errorf("expected %s to have moved to %s", key, shard)
+		}
+	}
+	if len(transferer.Keys("node-a:1"))+len(transferer.Keys("node-b:1")) != len(keys) {
+		t.Error("expected every key to live on exactly one member")
+	}
+}
+
+func TestConsistentHashing_RollbackRestoresWrites(t *testing.T) {
+	keys := testKeys(100)
+	ch, transferer := newMemoryCluster(t, keys)
+	transferer.Fail("node-a:1", OpFetch, -1)
+
+	// write a key owned by the new member while the migration is in flight
+	var written string
+	ch.Subscribe(func(e Event) {
+		if e.Type != MigrationStarted {
+			return
+		}
+		for _, key := range keys {
+			route, done, err := ch.BeginWrite(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if route.Shards[0] == "node-b:1" {
+				_ = transferer.Store("node-b:1", key, []byte("new"))
+				written = key
+				done()
+				return
+			}
+			done()
+		}
+	})
+
+	if err := ch.AddMember("node-b:1"); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if written == "" {
+		t.Fatal("expected a key to be written during the migration")
+	}
+	if string(transferer.Keys("node-a:1")[written]) != "new" {
+		t.Errorf("expected the write to %s to be moved back to the previous owner", written)
+	}
+	if len(transferer.Keys("node-b:1")) != 0 {
+		t.Error("expected nothing left on the member that was rolled back")
+	}
+}
@@ -0,0 +1,117 @@
+package consistenthashing
+
+import (
+	"fmt"
+	"sort"
+)
+
+// multiProbeCount is the number of probes per lookup, 21 keeps the peak to average load ratio around 1.05
+const multiProbeCount = 21
+
+type multiProbePoint struct {
+	position uint64
+	member   string
+}
+
+/*
+multiProbe is Appleton and O'Reilly's multi-probe consistent hashing: members sit at a few points of a 64-bit ring and
+a key is hashed multiProbeCount times, belonging to the member whose point is closest clockwise to any of the probes.
+*/
+type multiProbe struct {
+	hashFunc HashingFunc
+	// points is the number of ring points a member of weight 1 occupies
+	points int
+	ring   []multiProbePoint
+}
+
+func (mp *multiProbe) Name() string {
+	return MultiProbePartitioner
+}
+
+// Locate orders members by the closest distance any probe found them at, then walks the ring for anything unreached
+func (mp *multiProbe) Locate(key string, n int) []string {
+	if len(mp.ring) == 0 {
+		return nil
+	}
+	best := make(map[string]uint64)
+	for probe := 0; probe < multiProbeCount; probe++ {
+		pos := mix64(uint64(mp.hashFunc(fmt.Sprintf("%s#%d", key, probe))))
+		point := mp.ring[mp.successor(pos)]
+		distance := point.position - pos
+		if current, ok := best[point.member]; !ok || distance < current {
+			best[point.member] = distance
+		}
+	}
+
+	owners := make([]string, 0, len(best))
+	for member := range best {
+		owners = append(owners, member)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if best[owners[i]] != best[owners[j]] {
+			return best[owners[i]] < best[owners[j]]
+		}
+		return owners[i] < owners[j]
+	})
+	if len(owners) >= n {
+		return owners[:n]
+	}
+
+	start := mp.successor(mix64(uint64(mp.hashFunc(key))))
+	for i := 0; i < len(mp.ring) && len(owners) < n; i++ {
+		member := mp.ring[(start+i)%len(mp.ring)].member
+		if _, ok := best[member]; !ok {
+			best[member] = 0
+			owners = append(owners, member)
+		}
+	}
+	return owners
+}
+
+func (mp *multiProbe) Add(member string, weight int) (Partitioner, error) {
+	next := mp.without(member)
+	for point := 0; point < weight*mp.points; point++ {
+		next.ring = append(next.ring, multiProbePoint{
+			position: mix64(uint64(mp.hashFunc(vnodeKey(member, point)))),
+			member:   member,
+		})
+	}
+	sort.Slice(next.ring, func(i, j int) bool {
+		return next.ring[i].position < next.ring[j].position
+	})
+	return next, nil
+}
+
+func (mp *multiProbe) Remove(member string) Partitioner {
+	return mp.without(member)
+}
+
+func (mp *multiProbe) Members() []string {
+	seen := make(map[string]bool)
+	var members []string
+	for _, point := range mp.ring {
+		if !seen[point.member] {
+			seen[point.member] = true
+			members = append(members, point.member)
+		}
+	}
+	return members
+}
+
+func (mp *multiProbe) without(member string) *multiProbe {
+	next := &multiProbe{hashFunc: mp.hashFunc, points: mp.points}
+	for _, point := range mp.ring {
+		if point.member != member {
+			next.ring = append(next.ring, point)
+		}
+	}
+	return next
+}
+
+// successor is the index of the first point at or after pos, wrapping around to the start of the ring
+func (mp *multiProbe) successor(pos uint64) int {
+	idx := sort.Search(len(mp.ring), func(i int) bool {
+		return mp.ring[i].position >= pos
+	})
+	return idx % len(mp.ring)
+}
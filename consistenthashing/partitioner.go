@@ -0,0 +1,128 @@
+package consistenthashing
+
+import (
+	"errors"
+	"sort"
+)
+
+/*
+Partitioner decides which members own a key. Implementations are immutable values: adding or removing a member returns
+a new Partitioner, so the placement from before a membership change stays around to work out which keys have to move.
+*/
+type Partitioner interface {
+	// Name identifies the placement algorithm
+	Name() string
+	// Locate returns up to n distinct members for key, in order of preference
+	Locate(key string, n int) []string
+	// Add returns a Partitioner that also places member, or changes its weight when it is already placed
+	Add(member string, weight int) (Partitioner, error)
+	// Remove returns a Partitioner without member
+	Remove(member string) Partitioner
+	// Members lists the members keys are placed on
+	Members() []string
+}
+
+// Partitioner names accepted by NewPartitioner
+const (
+	RingPartitioner       = "ring"
+	JumpPartitioner       = "jump"
+	RendezvousPartitioner = "rendezvous"
+	MaglevPartitioner     = "maglev"
+	MultiProbePartitioner = "multiprobe"
+)
+
+/*
+NewPartitioner builds an empty Partitioner by name. ringSize and vnodes only apply to the ring, vnodes doubles as the
+number of points per unit of weight for multi-probe hashing.
+*/
+func NewPartitioner(name string, hashFunc HashingFunc, ringSize int, vnodes int) (Partitioner, error) {
+	switch name {
+	case RingPartitioner:
+		return newRing(hashFunc, ringSize, vnodes), nil
+	case JumpPartitioner:
+		return &jump{hashFunc: hashFunc}, nil
+	case RendezvousPartitioner:
+		return &rendezvous{hashFunc: hashFunc, weights: map[string]int{}}, nil
+	case MaglevPartitioner:
+		return newMaglev(hashFunc, map[string]int{}), nil
+	case MultiProbePartitioner:
+		if vnodes < 1 {
+			vnodes = 1
+		}
+		return &multiProbe{hashFunc: hashFunc, points: vnodes}, nil
+	}
+	return nil, errors.New("unknown partitioner " + name)
+}
+
+/*
+NewPartitioner64 builds an empty Partitioner by name that hashes onto the full 64-bit space of hash64. The ring spans
+the whole space instead of a fixed ring size.
+*/
+func NewPartitioner64(name string, hash64 HashingFunc64, vnodes int) (Partitioner, error) {
+	if name == RingPartitioner {
+		return newRing64(hash64, vnodes), nil
+	}
+	// the other placements mix whatever the hash returns, the conversion back to uint64 is lossless
+	return NewPartitioner(name, func(s string) int {
+		return int(hash64(s))
+	}, 0, vnodes)
+}
+
+// Balance counts how many of keys each member is the primary owner of
+func Balance(p Partitioner, keys []string) map[string]int {
+	counts := make(map[string]int)
+	for _, member := range p.Members() {
+		counts[member] = 0
+	}
+	for _, key := range keys {
+		owners := p.Locate(key, 1)
+		if len(owners) > 0 {
+			counts[owners[0]]++
+		}
+	}
+	return counts
+}
+
+// Movement returns the fraction of keys whose primary owner differs between two placements
+func Movement(before Partitioner, after Partitioner, keys []string) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+	moved := 0
+	for _, key := range keys {
+		prev, next := before.Locate(key, 1), after.Locate(key, 1)
+		if len(prev) == 0 || len(next) == 0 || prev[0] != next[0] {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(keys))
+}
+
+// mix64 is the splitmix64 finalizer, it spreads hashes that only use a few bits (like a 32-bit FNV) over 64 bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// sortedMembers returns the members of a weight table in a stable order
+func sortedMembers(weights map[string]int) []string {
+	members := make([]string, 0, len(weights))
+	for member := range weights {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// copyWeights copies a weight table so a new Partitioner can change it without touching the previous one
+func copyWeights(weights map[string]int) map[string]int {
+	next := make(map[string]int, len(weights))
+	for member, weight := range weights {
+		next[member] = weight
+	}
+	return next
+}
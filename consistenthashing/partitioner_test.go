@@ -0,0 +1,145 @@
+package consistenthashing
+
+import (
+	"fmt"
+	"testing"
+)
+
+var partitionerNames = []string{RingPartitioner, JumpPartitioner, RendezvousPartitioner, MaglevPartitioner, MultiProbePartitioner}
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func buildPartitioner(t *testing.T, name string, members int) Partitioner {
+	p, err := NewPartitioner(name, testHash, 1000003, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < members; i++ {
+		p, err = p.Add(fmt.Sprintf("10.0.0.%d:8080", i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestPartitioner_LocateReturnsDistinctMembers(t *testing.T) {
+	for _, name := range partitionerNames {
+		p := buildPartitioner(t, name, 5)
+		for _, key := range testKeys(100) {
+			owners := p.Locate(key, 3)
+			if len(owners) != 3 {
+				t.Fatalf("%s: expected 3 owners, got %v", name, owners)
+			}
+			if owners[0] == owners[1] || owners[1] == owners[2] || owners[0] == owners[2] {
+				t.Fatalf("%s: expected distinct owners, got %v", name, owners)
+			}
+			if again := p.Locate(key, 3); fmt.Sprint(again) != fmt.Sprint(owners) {
+				t.Fatalf("%s: expected stable owners, got %v then %v", name, owners, again)
+			}
+		}
+		if all := p.Locate("key", 10); len(all) != 5 {
+			t.Errorf("%s: expected every member when asking for more than there are, got %v", name, all)
+		}
+	}
+}
+
+func TestPartitioner_BalanceAndMovement(t *testing.T) {
+	keys := testKeys(20000)
+	for _, name := range partitionerNames {
+		p := buildPartitioner(t, name, 5)
+		for member, count := range Balance(p, keys) {
+			// a fair share is 4000 keys
+			if count < 2500 || count > 5500 {
+				t.Errorf("%s: %s owns %d keys, expected close to 4000", name, member, count)
+			}
+		}
+
+		grown, err := p.Add("10.0.0.99:8080", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a new sixth member should take about a sixth of the keys and nothing else should move
+		if moved := Movement(p, grown, keys); moved > 0.25 {
+			t.Errorf("%s: adding a member moved %.2f of the keys", name, moved)
+		}
+		if moved := Movement(grown, grown.Remove("10.0.0.99:8080"), keys); moved > 0.25 {
+			t.Errorf("%s: removing the last member moved %.2f of the keys", name, moved)
+		}
+	}
+}
+
+func TestPartitioner_Weights(t *testing.T) {
+	keys := testKeys(20000)
+	for _, name := range partitionerNames {
+		p := buildPartitioner(t, name, 2)
+		heavy, err := p.Add("10.0.0.0:8080", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		balance := Balance(heavy, keys)
+		if balance["10.0.0.0:8080"] < 2*balance["10.0.0.1:8080"] {
+			t.Errorf("%s: expected weight 3 member to own about three times as much, got %v", name, balance)
+		}
+		if len(heavy.Members()) != 2 {
+			t.Errorf("%s: expected reweighting to keep 2 members, got %v", name, heavy.Members())
+		}
+	}
+}
+
+func TestConsistentHashing_AlternativePartitioners(t *testing.T) {
+	for _, name := range partitionerNames[1:] {
+		p, err := NewPartitioner(name, testHash, 1000003, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := newTestConsistentHashing(WithPartitioner(p), WithReplicationFactor(2))
+		nodes := make(map[string]*testNode)
+		var order []string
+		for i := 0; i < 4; i++ {
+			node := newTestNode(t)
+			nodes[node.addr()] = node
+			order = append(order, node.addr())
+		}
+		for _, addr := range order[:2] {
+			if err := ch.AddMember(addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		keys := testKeys(100)
+		for _, key := range keys {
+			shards, err := ch.GetShards(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, shard := range shards {
+				nodes[shard].mu.Lock()
+				nodes[shard].store[key] = "val-" + key
+				nodes[shard].mu.Unlock()
+			}
+		}
+
+		for _, addr := range order[2:] {
+			if err := ch.AddMember(addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertReplicas(t, ch, nodes, keys)
+
+		if err := ch.RemoveMember(order[0]); err != nil {
+			t.Fatal(err)
+		}
+		delete(nodes, order[0])
+		assertReplicas(t, ch, nodes, keys)
+	}
+
+	if _, err := NewPartitioner("unknown", testHash, 10, 1); err == nil {
+		t.Error("expected an unknown partitioner name to be rejected")
+	}
+}
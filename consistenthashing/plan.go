@@ -0,0 +1,176 @@
+package consistenthashing
+
+import (
+	"errors"
+	"sort"
+)
+
+// Plan describes what a membership change would move, worked out without applying it
+type Plan struct {
+	// Epoch is the epoch the plan was worked out against, the plan is stale once the cluster moves on from it
+	Epoch  uint64   `json:"epoch"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+	// Ranges lists the ring ranges whose preference list would change, it is only known for the ring
+	Ranges []RangeMove `json:"ranges,omitempty"`
+	// Keys lists every stored key that would be copied to a new owner or dropped by a member that no longer owns it
+	Keys []KeyMove `json:"keys"`
+	// Transfers sums up Keys per pair of members
+	Transfers  []Transfer `json:"transfers"`
+	TotalKeys  int        `json:"totalKeys"`
+	TotalBytes int64      `json:"totalBytes"`
+}
+
+// RangeMove is a range of ring positions whose preference list changes from From to To
+type RangeMove struct {
+	Range Range    `json:"range"`
+	From  []string `json:"from"`
+	To    []string `json:"to"`
+}
+
+// KeyMove is a key held by From that would be copied to To, and deleted from From when Drop is set
+type KeyMove struct {
+	Key   string   `json:"key"`
+	From  string   `json:"from"`
+	To    []string `json:"to,omitempty"`
+	Drop  bool     `json:"drop,omitempty"`
+	Bytes int64    `json:"bytes"`
+}
+
+// Transfer is the number of keys and bytes that would be copied from one member to another
+type Transfer struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
+
+/*
+Plan works out what adding addMembers, with a weight of 1, and removing removeMembers would move, without changing the
+cluster. Key moves follow the same rules redistribute applies, against the keys every current member reports holding,
+and the size of every key that would be copied is read from the member holding it. In bounded load mode the plan
+follows the placement, it does not know where keys would spill over to.
+*/
+func (ch *ConsistentHashing) Plan(addMembers []string, removeMembers []string) (*Plan, error) {
+	previous := ch.current.Load()
+	next := previous.placement
+	for _, member := range removeMembers {
+		if _, ok := previous.weights[member]; !ok {
+			return nil, errors.New("no server with address " + member + " in cluster")
+		}
+		next = next.Remove(member)
+	}
+	for _, member := range addMembers {
+		if _, ok := previous.weights[member]; ok || contains(next.Members(), member) {
+			return nil, errors.New("server " + member + " already in cluster")
+		}
+		var err error
+		next, err = next.Add(member, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &Plan{Epoch: previous.epoch, Add: addMembers, Remove: removeMembers, Keys: []KeyMove{}, Transfers: []Transfer{}}
+	if prevRing, ok := previous.placement.(*ring); ok {
+		plan.Ranges = prevRing.rangeMoves(next.(*ring), ch.replicas)
+	}
+
+	transfers := make(map[[2]string]*Transfer)
+	for _, from := range sortedMembers(previous.weights) {
+		keys, err := ch.transferer.ListKeys(from)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			oldOwners := previous.placement.Locate(key, ch.replicas)
+			newOwners := next.Locate(key, ch.replicas)
+
+			move := KeyMove{Key: key, From: from, Drop: !contains(newOwners, from)}
+			if len(oldOwners) == 0 || oldOwners[0] == from || !contains(oldOwners, from) {
+				for _, owner := range newOwners {
+					if owner != from && !contains(oldOwners, owner) {
+						move.To = append(move.To, owner)
+					}
+				}
+			}
+			if len(move.To) == 0 && !move.Drop {
+				continue
+			}
+
+			if len(move.To) > 0 {
+				value, err := ch.transferer.Fetch(from, key)
+				if errors.Is(err, ErrKeyNotFound) {
+					// deleted since it was listed, nothing left to move
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				move.Bytes = int64(len(value))
+				plan.TotalKeys++
+			}
+			for _, to := range move.To {
+				transfer, ok := transfers[[2]string{from, to}]
+				if !ok {
+					transfer = &Transfer{From: from, To: to}
+					transfers[[2]string{from, to}] = transfer
+				}
+				transfer.Keys++
+				transfer.Bytes += move.Bytes
+				plan.TotalBytes += move.Bytes
+			}
+			plan.Keys = append(plan.Keys, move)
+		}
+	}
+
+	for _, transfer := range transfers {
+		plan.Transfers = append(plan.Transfers, *transfer)
+	}
+	sort.Slice(plan.Transfers, func(i, j int) bool {
+		if plan.Transfers[i].From != plan.Transfers[j].From {
+			return plan.Transfers[i].From < plan.Transfers[j].From
+		}
+		return plan.Transfers[i].To < plan.Transfers[j].To
+	})
+	return plan, nil
+}
+
+/*
+rangeMoves compares the preference lists of every range between two consecutive positions of either ring, and returns
+the ranges whose list changes in next, merging neighbouring ranges that change the same way.
+*/
+func (r *ring) rangeMoves(next *ring, replicas int) []RangeMove {
+	var bounds []uint64
+	seen := make(map[uint64]bool)
+	for _, entries := range [][]*ringMember{r.partitionsRing, next.partitionsRing} {
+		for _, entry := range entries {
+			if !seen[entry.position] {
+				seen[entry.position] = true
+				bounds = append(bounds, entry.position)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i] < bounds[j]
+	})
+
+	var moves []RangeMove
+	for i, end := range bounds {
+		// neither preference list changes within (previous bound, end], so looking up end covers the whole range
+		from := r.preferenceList(end, replicas)
+		to := next.preferenceList(end, replicas)
+		if sameOwners(from, to) {
+			continue
+		}
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		if last := len(moves) - 1; last >= 0 && moves[last].Range.End == start && sameOwners(moves[last].From, from) && sameOwners(moves[last].To, to) {
+			moves[last].Range.End = end
+			continue
+		}
+		moves = append(moves, RangeMove{Range: Range{Start: start, End: end}, From: from, To: to})
+	}
+	return moves
+}
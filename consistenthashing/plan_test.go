@@ -0,0 +1,99 @@
+package consistenthashing
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConsistentHashing_PlanMatchesRedistribution(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(8))
+	nodes := make(map[string]*testNode)
+	var order []string
+	for i := 0; i < 4; i++ {
+		node := newTestNode(t)
+		nodes[node.addr()] = node
+		order = append(order, node.addr())
+	}
+	for _, addr := range order[:3] {
+		if err := ch.AddMember(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total := 200
+	holders := make(map[string]string)
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		upload(t, ch, nodes, key)
+		holders[key], _ = ch.GetShard(key)
+	}
+
+	plan, err := ch.Plan([]string{order[3]}, []string{order[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Topology().Epoch != 3 || len(ch.Topology().Members) != 3 {
+		t.Fatal("expected planning to leave the cluster untouched")
+	}
+	if _, err := ch.Plan([]string{order[1]}, nil); err == nil {
+		t.Error("expected planning to add an existing member to fail")
+	}
+	if _, err := ch.Plan(nil, []string{order[3]}); err == nil {
+		t.Error("expected planning to remove an unknown member to fail")
+	}
+
+	if err := ch.AddMember(order[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.RemoveMember(order[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	planned := make(map[string]KeyMove)
+	var bytes int64
+	for _, move := range plan.Keys {
+		planned[move.Key] = move
+		bytes += move.Bytes
+		if move.Bytes <= 0 {
+			t.Errorf("expected the size of %s to be known", move.Key)
+		}
+	}
+	moved := 0
+	for key, holder := range holders {
+		shard, _ := ch.GetShard(key)
+		move, ok := planned[key]
+		if shard == holder {
+			if ok {
+				t.Errorf("key %s stays on %s but is planned to move", key, holder)
+			}
+			continue
+		}
+		moved++
+		if !ok || move.From != holder || !reflect.DeepEqual(move.To, []string{shard}) || !move.Drop {
+			t.Errorf("expected key %s to be planned from %s to %s, got %+v", key, holder, shard, move)
+		}
+	}
+	if plan.TotalKeys != moved || plan.TotalBytes != bytes {
+		t.Errorf("expected totals of %d keys and %d bytes, got %d and %d", moved, bytes, plan.TotalKeys, plan.TotalBytes)
+	}
+
+	transferred := 0
+	for _, transfer := range plan.Transfers {
+		transferred += transfer.Keys
+	}
+	if transferred != moved {
+		t.Errorf("expected the transfers to add up to %d keys, got %d", moved, transferred)
+	}
+
+	// every moved key lies in one of the planned ranges
+	for key := range planned {
+		pos := ch.partitioner.(*ring).position(key)
+		found := false
+		for _, rng := range plan.Ranges {
+			found = found || rng.Range.Contains(pos)
+		}
+		if !found {
+			t.Errorf("key %s at %d moves outside of the planned ranges", key, pos)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package consistenthashing
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+rendezvous is highest random weight hashing: every member scores every key and the highest scores win. Weights use the
+logarithmic method, so a member's share of the key space is proportional to its weight.
+*/
+type rendezvous struct {
+	hashFunc HashingFunc
+	weights  map[string]int
+}
+
+func (r *rendezvous) Name() string {
+	return RendezvousPartitioner
+}
+
+func (r *rendezvous) Locate(key string, n int) []string {
+	members := sortedMembers(r.weights)
+	scores := make(map[string]float64, len(members))
+	for _, member := range members {
+		scores[member] = r.score(member, key)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return scores[members[i]] > scores[members[j]]
+	})
+	if len(members) > n {
+		members = members[:n]
+	}
+	return members
+}
+
+func (r *rendezvous) Add(member string, weight int) (Partitioner, error) {
+	next := &rendezvous{hashFunc: r.hashFunc, weights: copyWeights(r.weights)}
+	next.weights[member] = weight
+	return next, nil
+}
+
+func (r *rendezvous) Remove(member string) Partitioner {
+	next := &rendezvous{hashFunc: r.hashFunc, weights: copyWeights(r.weights)}
+	delete(next.weights, member)
+	return next
+}
+
+func (r *rendezvous) Members() []string {
+	return sortedMembers(r.weights)
+}
+
+func (r *rendezvous) score(member string, key string) float64 {
+	h := mix64(uint64(r.hashFunc(member + "/" + key)))
+	// uniform in (0, 1), never 0 so the logarithm stays finite
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return float64(r.weights[member]) / -math.Log(u)
+}
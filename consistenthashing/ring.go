@@ -1,38 +1,169 @@
 package consistenthashing
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
 
 type ringMember struct {
 	address string
-	// position is decided by hashing address
-	position int
+	// vnode is the index of this entry among the virtual nodes owned by address
+	vnode int
+	// position is decided by hashing address and vnode
+	position uint64
 }
 
+/*
+ring is the classic consistent hashing placement: every member is hashed onto vnodes positions of a ring of the given
+size, and a key belongs to the first members found walking clockwise from the key's own position. A ring of size 0
+spans the full 64-bit hash space of hash64 instead.
+*/
 type ring struct {
-	size           int
+	size     uint64
+	hashFunc HashingFunc
+	hash64   HashingFunc64
+	// vnodes is the number of positions a member of weight 1 occupies
+	vnodes         int
 	partitionsRing []*ringMember
 }
 
-func (r *ring) insert(newNode *ringMember) int {
-	insertionIdx := 0
-	for idx, member := range r.partitionsRing {
-		if newNode.position > member.position {
-			insertionIdx = idx + 1
+func newRing(hashFunc HashingFunc, size int, vnodes int) *ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &ring{size: uint64(size), hashFunc: hashFunc, vnodes: vnodes}
+}
+
+// newRing64 builds a ring over the full 64-bit hash space, where collisions are practically impossible
+func newRing64(hash64 HashingFunc64, vnodes int) *ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &ring{hash64: hash64, vnodes: vnodes}
+}
+
+func (r *ring) Name() string {
+	return "ring"
+}
+
+func (r *ring) Locate(key string, n int) []string {
+	return r.preferenceList(r.position(key), n)
+}
+
+/*
+Add places the virtual nodes member is missing for its weight, or drops its highest ones when the weight shrinks, so
+that only the ranges in front of the changed virtual nodes change hands. A virtual node hashing onto a position that is
+already taken is rehashed with an increasing salt until it finds a free one, so no two entries ever share a position.
+The resolution depends on the order members were added in, so resolved positions are what should be persisted.
+*/
+func (r *ring) Add(member string, weight int) (Partitioner, error) {
+	next := r.clone()
+	current := len(next.findAll(member))
+	want := weight * next.vnodes
+	if want > current && next.size > 0 && uint64(len(next.partitionsRing)+want-current) > next.size {
+		return nil, errors.New("ring is full, no free positions left for the new virtual nodes")
+	}
+
+	taken := make(map[uint64]bool, len(next.partitionsRing))
+	for _, entry := range next.partitionsRing {
+		taken[entry.position] = true
+	}
+	if want-current == 1 {
+		next.insert(&ringMember{address: member, vnode: current, position: next.resolvePosition(member, current, taken)})
+	} else if want > current {
+		// sorting once beats shifting the ring for every one of many virtual nodes
+		for vnode := current; vnode < want; vnode++ {
+			nodePos := next.resolvePosition(member, vnode, taken)
+			next.partitionsRing = append(next.partitionsRing, &ringMember{address: member, vnode: vnode, position: nodePos})
+		}
+		sort.Slice(next.partitionsRing, func(i, j int) bool {
+			return next.partitionsRing[i].position < next.partitionsRing[j].position
+		})
+	}
+	next.removeVirtualNodes(member, want)
+	return next, nil
+}
+
+// resolvePosition hashes a virtual node onto the first free position of the salted sequence and marks it as taken
+func (r *ring) resolvePosition(member string, vnode int, taken map[uint64]bool) uint64 {
+	key := vnodeKey(member, vnode)
+	pos := r.position(key)
+	for salt := 1; taken[pos]; salt++ {
+		pos = r.position(fmt.Sprintf("%s~%d", key, salt))
+	}
+	taken[pos] = true
+	return pos
+}
+
+// position maps s onto the ring, keeping negative hashes on the ring as well
+func (r *ring) position(s string) uint64 {
+	if r.size == 0 {
+		return r.hash64(s)
+	}
+	pos := r.hashFunc(s) % int(r.size)
+	if pos < 0 {
+		pos += int(r.size)
+	}
+	return uint64(pos)
+}
+
+// positions returns the resolved positions of every virtual node of member, in virtual node order
+func (r *ring) positions(member string) []uint64 {
+	positions := make([]uint64, len(r.findAll(member)))
+	for _, entry := range r.partitionsRing {
+		if entry.address == member {
+			positions[entry.vnode] = entry.position
 		}
 	}
+	return positions
+}
+
+func (r *ring) Remove(member string) Partitioner {
+	next := r.clone()
+	next.removeMember(member)
+	return next
+}
+
+func (r *ring) Members() []string {
+	return r.members()
+}
 
-	leftPart := r.partitionsRing[:insertionIdx]
-	rightPart := r.partitionsRing[insertionIdx:]
+// insert binary searches for the first entry whose position is not smaller than the new node's and inserts in front of it
+func (r *ring) insert(newNode *ringMember) int {
+	insertionIdx := r.search(newNode.position)
 
-	r.partitionsRing = append(leftPart, append([]*ringMember{newNode}, rightPart...)...)
+	r.partitionsRing = append(r.partitionsRing, nil)
+	copy(r.partitionsRing[insertionIdx+1:], r.partitionsRing[insertionIdx:])
+	r.partitionsRing[insertionIdx] = newNode
 
 	return insertionIdx
 }
 
+// search returns the index of the first entry positioned at or after pos, len(partitionsRing) when there is none
+func (r *ring) search(pos uint64) int {
+	return sort.Search(len(r.partitionsRing), func(i int) bool {
+		return r.partitionsRing[i].position >= pos
+	})
+}
+
 func (r *ring) getNextRingMember(idx int) *ringMember {
 	return r.partitionsRing[(idx+1)%len(r.partitionsRing)]
 }
 
+// getSuccessor walks clockwise from idx and returns the first entry that belongs to a different physical member, or nil
+// when every entry on the ring belongs to the same member
+func (r *ring) getSuccessor(idx int) *ringMember {
+	curr := r.partitionsRing[idx]
+	for i := 1; i < len(r.partitionsRing); i++ {
+		next := r.partitionsRing[(idx+i)%len(r.partitionsRing)]
+		if next.address != curr.address {
+			return next
+		}
+	}
+	return nil
+}
+
 func (r *ring) get(idx int) (*ringMember, error) {
 	if idx >= len(r.partitionsRing) {
 		return nil, errors.New("out of range")
@@ -49,6 +180,17 @@ func (r *ring) find(nodeAddr string) int {
 	return -1
 }
 
+// findAll returns the indexes of every virtual node owned by nodeAddr
+func (r *ring) findAll(nodeAddr string) []int {
+	var idxs []int
+	for idx, member := range r.partitionsRing {
+		if nodeAddr == member.address {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
 func (r *ring) remove(idx int) error {
 	if idx < 0 || idx > len(r.partitionsRing) {
 		return errors.New("invalid argument range")
@@ -58,19 +200,142 @@ func (r *ring) remove(idx int) error {
 	return nil
 }
 
-func (r *ring) getOwner(dataPos int) (*ringMember, error) {
+// removeMember removes every virtual node owned by nodeAddr and returns the removed entries
+func (r *ring) removeMember(nodeAddr string) []*ringMember {
+	return r.removeVirtualNodes(nodeAddr, 0)
+}
+
+// removeVirtualNodes removes the virtual nodes of nodeAddr whose index is at least fromVnode and returns them
+func (r *ring) removeVirtualNodes(nodeAddr string, fromVnode int) []*ringMember {
+	var removed []*ringMember
+	kept := r.partitionsRing[:0]
+	for _, member := range r.partitionsRing {
+		if member.address == nodeAddr && member.vnode >= fromVnode {
+			removed = append(removed, member)
+			continue
+		}
+		kept = append(kept, member)
+	}
+	r.partitionsRing = kept
+	return removed
+}
+
+func (r *ring) getOwner(dataPos uint64) (*ringMember, error) {
 	if len(r.partitionsRing) == 0 {
 		return nil, errors.New("no servers")
 	}
 
-	var pre int
-	for pre < len(r.partitionsRing) && dataPos > r.partitionsRing[pre].position {
-		pre++
+	return r.partitionsRing[r.ownerIdx(dataPos)], nil
+}
+
+// ownerIdx is the index of the first entry at or after dataPos, wrapping around to the start of the ring
+func (r *ring) ownerIdx(dataPos uint64) int {
+	return r.search(dataPos) % len(r.partitionsRing)
+}
+
+// preferenceList walks clockwise from the owner of dataPos and returns the first n distinct physical members
+func (r *ring) preferenceList(dataPos uint64, n int) []string {
+	if len(r.partitionsRing) == 0 {
+		return nil
 	}
 
-	return r.partitionsRing[pre%len(r.partitionsRing)], nil
+	start := r.ownerIdx(dataPos)
+	seen := make(map[string]bool)
+	var owners []string
+	for i := 0; i < len(r.partitionsRing) && len(owners) < n; i++ {
+		member := r.partitionsRing[(start+i)%len(r.partitionsRing)]
+		if !seen[member.address] {
+			seen[member.address] = true
+			owners = append(owners, member.address)
+		}
+	}
+	return owners
+}
+
+// clone copies the ring so that it can be mutated while the copy keeps describing the previous placement
+func (r *ring) clone() *ring {
+	return &ring{
+		size:           r.size,
+		hashFunc:       r.hashFunc,
+		hash64:         r.hash64,
+		vnodes:         r.vnodes,
+		partitionsRing: append([]*ringMember(nil), r.partitionsRing...),
+	}
+}
+
+// withPositions returns a copy of r that also places member at exactly positions, one virtual node each in order
+func (r *ring) withPositions(member string, positions []uint64) *ring {
+	next := r.clone()
+	for vnode, position := range positions {
+		next.insert(&ringMember{address: member, vnode: vnode, position: position})
+	}
+	return next
+}
+
+/*
+affectedBy returns the members that may hold a key whose preference list changed when member went from its virtual
+nodes in previous to the ones it has in r. Members that only gained virtual nodes hold nothing yet, members that lost
+some are included themselves since their keys have to move out.
+*/
+func (r *ring) affectedBy(previous *ring, member string, replicas int) []string {
+	before, after := len(previous.findAll(member)), len(r.findAll(member))
+	if after > before {
+		return r.affectedMembers(member, before, replicas)
+	}
+	return append(previous.affectedMembers(member, after, replicas), member)
+}
+
+/*
+affectedMembers returns the members, other than serverAddr, that can hold a replica of a key whose preference list
+goes through one of serverAddr's virtual nodes numbered fromVnode and up. Walking back from such a virtual node, keys
+owned by the previous replicas-1 distinct members reach it before their preference list is full, walking forward the
+next replicas distinct members hold the rest of those lists. With a replication factor of 1 this is just the successor.
+*/
+func (r *ring) affectedMembers(serverAddr string, fromVnode int, replicas int) []string {
+	var affected []string
+	seen := map[string]bool{serverAddr: true}
+	collect := func(idx int, step int, limit int) {
+		found := make(map[string]bool)
+		for i := 1; i < len(r.partitionsRing) && len(found) < limit; i++ {
+			member := r.partitionsRing[((idx+step*i)%len(r.partitionsRing)+len(r.partitionsRing))%len(r.partitionsRing)]
+			if member.address == serverAddr || found[member.address] {
+				continue
+			}
+			found[member.address] = true
+			if !seen[member.address] {
+				seen[member.address] = true
+				affected = append(affected, member.address)
+			}
+		}
+	}
+	for _, idx := range r.findAll(serverAddr) {
+		if r.partitionsRing[idx].vnode < fromVnode {
+			continue
+		}
+		collect(idx, -1, replicas-1)
+		collect(idx, 1, replicas)
+	}
+	return affected
 }
 
 func (r *ring) numServers() int {
 	return len(r.partitionsRing)
 }
+
+// numMembers counts distinct physical members, as opposed to numServers which counts virtual nodes
+func (r *ring) numMembers() int {
+	return len(r.members())
+}
+
+// members returns the distinct physical addresses on the ring in the order they are first seen
+func (r *ring) members() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, member := range r.partitionsRing {
+		if !seen[member.address] {
+			seen[member.address] = true
+			addrs = append(addrs, member.address)
+		}
+	}
+	return addrs
+}
@@ -1,7 +1,10 @@
 package consistenthashing
 
 import (
+	"fmt"
 	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -9,7 +12,7 @@ func TestConsistenhashing_RingInsert(t *testing.T) {
 	testRing := &ring{size: 800}
 
 	for i := 0; i < 100; i++ {
-		testRing.insert(&ringMember{address: "", position: rand.Intn(600)})
+		testRing.insert(&ringMember{address: "", position: uint64(rand.Intn(600))})
 	}
 
 	for i := 1; i < 100; i++ {
@@ -63,7 +66,7 @@ func TestConsistenhashing_RingGetOwner(t *testing.T) {
 func TestConsistentHashing_RingRemove(t *testing.T) {
 	testRing := &ring{size: 270}
 	for i := 0; i < 100; i++ {
-		testRing.insert(&ringMember{address: "", position: i})
+		testRing.insert(&ringMember{address: "", position: uint64(i)})
 	}
 
 	for i := 0; i < 60; i++ {
@@ -87,3 +90,143 @@ func TestConsistentHashing_RingRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestConsistentHashing_RingVirtualNodes(t *testing.T) {
+	testRing := &ring{
+		size: 800,
+		partitionsRing: []*ringMember{
+			{address: "a", vnode: 0, position: 20},
+			{address: "a", vnode: 1, position: 160},
+			{address: "b", vnode: 0, position: 190},
+			{address: "a", vnode: 2, position: 220},
+			{address: "c", vnode: 0, position: 400},
+		},
+	}
+
+	if testRing.numServers() != 5 || testRing.numMembers() != 3 {
+		t.Fail()
+	}
+
+	if next := testRing.getSuccessor(0); next == nil || next.address != "b" {
+		t.Fail()
+	}
+
+	if next := testRing.getSuccessor(4); next == nil || next.address != "a" {
+		t.Fail()
+	}
+
+	removed := testRing.removeMember("a")
+	if len(removed) != 3 || testRing.find("a") != -1 || len(testRing.findAll("b")) != 1 {
+		t.Fail()
+	}
+
+	res, err := testRing.getOwner(80)
+	if err != nil || res.address != "b" {
+		t.Fail()
+	}
+}
+
+func TestConsistentHashing_RingPreferenceList(t *testing.T) {
+	testRing := &ring{
+		size: 800,
+		partitionsRing: []*ringMember{
+			{address: "a", vnode: 0, position: 20},
+			{address: "a", vnode: 1, position: 160},
+			{address: "b", vnode: 0, position: 190},
+			{address: "a", vnode: 2, position: 220},
+			{address: "c", vnode: 0, position: 400},
+		},
+	}
+
+	if !reflect.DeepEqual(testRing.preferenceList(80, 2), []string{"a", "b"}) {
+		t.Fail()
+	}
+
+	if !reflect.DeepEqual(testRing.preferenceList(300, 3), []string{"c", "a", "b"}) {
+		t.Fail()
+	}
+
+	if !reflect.DeepEqual(testRing.preferenceList(200, 5), []string{"a", "c", "b"}) {
+		t.Fail()
+	}
+}
+
+func benchmarkRing(entries int) *ring {
+	testRing := &ring{size: uint64(entries * 100)}
+	for i := 0; i < entries; i++ {
+		testRing.insert(&ringMember{address: "", position: uint64(rand.Intn(entries * 100))})
+	}
+	return testRing
+}
+
+func BenchmarkConsistentHashing_RingGetOwner(b *testing.B) {
+	for _, entries := range []int{10, 1000, 100000} {
+		testRing := benchmarkRing(entries)
+		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = testRing.getOwner(uint64(i) % testRing.size)
+			}
+		})
+	}
+}
+
+func BenchmarkConsistentHashing_RingInsert(b *testing.B) {
+	for _, entries := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
+			testRing := benchmarkRing(entries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx := testRing.insert(&ringMember{address: "", position: uint64(rand.Intn(int(testRing.size)))})
+				_ = testRing.remove(idx)
+			}
+		})
+	}
+}
+
+func TestConsistentHashing_RingResolvesCollisions(t *testing.T) {
+	// every unsalted key lands on position 7
+	hash := func(s string) int {
+		if !strings.Contains(s, "~") {
+			return 7
+		}
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}
+	testRing := newRing(hash, 50, 3)
+
+	var p Partitioner = testRing
+	var err error
+	for _, addr := range []string{"a", "b", "c"} {
+		p, err = p.Add(addr, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := p.(*ring)
+
+	seen := make(map[uint64]bool)
+	for _, entry := range r.partitionsRing {
+		if seen[entry.position] {
+			t.Errorf("position %d is shared by more than one entry", entry.position)
+		}
+		seen[entry.position] = true
+	}
+	if !reflect.DeepEqual(r.positions("a"), []uint64{7, uint64(hash("a#1~1") % 50), uint64(hash("a#2~1") % 50)}) {
+		t.Errorf("expected the first member to keep the unsalted position, got %v", r.positions("a"))
+	}
+
+	// resolution only depends on what was placed before, so rebuilding in the same order gives the same positions
+	again, _ := newRing(hash, 50, 3).Add("a", 1)
+	again, _ = again.Add("b", 1)
+	again, _ = again.Add("c", 1)
+	if !reflect.DeepEqual(again.(*ring).positions("c"), r.positions("c")) {
+		t.Error("expected collision resolution to be deterministic")
+	}
+
+	if _, err := newRing(hash, 2, 3).Add("a", 1); err == nil {
+		t.Error("expected placing more virtual nodes than positions to fail")
+	}
+}
@@ -0,0 +1,382 @@
+package consistenthashing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// snapshotVersion is bumped whenever the layout of a Snapshot changes, in JSON or binary
+const snapshotVersion = 2
+
+// snapshotMagic starts every binary snapshot
+var snapshotMagic = []byte("CHSN")
+
+// ErrInvalidSnapshot is wrapped by every reason Validate rejects a snapshot for
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+/*
+Snapshot is a portable copy of the ring: every member with its weight and, for the ring, every virtual node at the
+position it was resolved to, in ring order, or for jump hashing the member of every bucket, in bucket order. It encodes
+to JSON with encoding/json and to a compact binary form with MarshalBinary, and loading it into another instance with
+Import or Restore places keys exactly the same way, as long as that instance is configured with the same placement.
+Partitioner and Fingerprint tell which placement that is.
+*/
+type Snapshot struct {
+	Version     int    `json:"version"`
+	Epoch       uint64 `json:"epoch"`
+	Partitioner string `json:"partitioner"`
+	Fingerprint string `json:"fingerprint"`
+	// RingSize is the number of positions on the ring, 0 when it spans the full 64-bit hash space
+	RingSize          uint64           `json:"ringSize"`
+	ReplicationFactor int              `json:"replicationFactor"`
+	Members           []SnapshotMember `json:"members"`
+	// Positions lists every virtual node on the ring sorted by position, it is empty for other placements
+	Positions []SnapshotPosition `json:"positions,omitempty"`
+	// Buckets lists the member of every jump bucket in bucket order, it is empty for other placements
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+type SnapshotMember struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+// SnapshotPosition is the VNode-th virtual node of Member, placed at Position
+type SnapshotPosition struct {
+	Position uint64 `json:"position"`
+	Member   string `json:"member"`
+	VNode    int    `json:"vnode"`
+}
+
+// Snapshot captures the membership lookups currently see
+func (ch *ConsistentHashing) Snapshot() *Snapshot {
+	return ch.snapshot(ch.current.Load())
+}
+
+// snapshot captures v along with the identity of the configured placement
+func (ch *ConsistentHashing) snapshot(v *view) *Snapshot {
+	s := &Snapshot{
+		Version:           snapshotVersion,
+		Epoch:             v.epoch,
+		Partitioner:       ch.partitioner.Name(),
+		Fingerprint:       ch.fingerprint(),
+		ReplicationFactor: ch.replicas,
+		Members:           make([]SnapshotMember, 0, len(v.weights)),
+	}
+	for _, member := range sortedMembers(v.weights) {
+		s.Members = append(s.Members, SnapshotMember{Address: member, Weight: v.weights[member]})
+	}
+	if r, ok := v.placement.(*ring); ok {
+		s.RingSize = r.size
+		for _, entry := range r.partitionsRing {
+			s.Positions = append(s.Positions, SnapshotPosition{Position: entry.position, Member: entry.address, VNode: entry.vnode})
+		}
+	}
+	if j, ok := v.placement.(*jump); ok {
+		s.Buckets = append([]string(nil), j.buckets...)
+	}
+	return s
+}
+
+/*
+Validate checks that s describes a ring that can actually be built: a supported version, distinct members of positive
+weight, positions that are strictly increasing, fit on the ring and give every member of the ring consecutive
+virtual nodes starting at 0, and jump buckets that give every member as many buckets as its weight.
+*/
+func (s *Snapshot) Validate() error {
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, s.Version)
+	}
+	if s.Partitioner == "" {
+		return fmt.Errorf("%w: no partitioner", ErrInvalidSnapshot)
+	}
+	if s.ReplicationFactor < 1 {
+		return fmt.Errorf("%w: replication factor %d", ErrInvalidSnapshot, s.ReplicationFactor)
+	}
+
+	vnodes := make(map[string]map[int]bool, len(s.Members))
+	for _, member := range s.Members {
+		if member.Address == "" {
+			return fmt.Errorf("%w: member without an address", ErrInvalidSnapshot)
+		}
+		if _, ok := vnodes[member.Address]; ok {
+			return fmt.Errorf("%w: duplicate address %s", ErrInvalidSnapshot, member.Address)
+		}
+		if member.Weight < 1 {
+			return fmt.Errorf("%w: weight %d of %s", ErrInvalidSnapshot, member.Weight, member.Address)
+		}
+		vnodes[member.Address] = make(map[int]bool)
+	}
+
+	if s.Partitioner != JumpPartitioner && len(s.Buckets) > 0 {
+		return fmt.Errorf("%w: buckets for the %s partitioner", ErrInvalidSnapshot, s.Partitioner)
+	}
+	if s.Partitioner != RingPartitioner && len(s.Positions) > 0 {
+		return fmt.Errorf("%w: positions for the %s partitioner", ErrInvalidSnapshot, s.Partitioner)
+	}
+	if s.Partitioner == JumpPartitioner {
+		return s.validateBuckets()
+	}
+	if s.Partitioner != RingPartitioner {
+		return nil
+	}
+	for i, position := range s.Positions {
+		if i > 0 && position.Position <= s.Positions[i-1].Position {
+			if position.Position == s.Positions[i-1].Position {
+				return fmt.Errorf("%w: duplicate position %d", ErrInvalidSnapshot, position.Position)
+			}
+			return fmt.Errorf("%w: position %d comes after %d", ErrInvalidSnapshot, position.Position, s.Positions[i-1].Position)
+		}
+		if s.RingSize > 0 && position.Position >= s.RingSize {
+			return fmt.Errorf("%w: position %d does not fit a ring of size %d", ErrInvalidSnapshot, position.Position, s.RingSize)
+		}
+		seen, ok := vnodes[position.Member]
+		if !ok {
+			return fmt.Errorf("%w: position %d of unknown member %s", ErrInvalidSnapshot, position.Position, position.Member)
+		}
+		if position.VNode < 0 || seen[position.VNode] {
+			return fmt.Errorf("%w: virtual node %d of %s placed twice", ErrInvalidSnapshot, position.VNode, position.Member)
+		}
+		seen[position.VNode] = true
+	}
+	for member, seen := range vnodes {
+		if len(seen) == 0 {
+			return fmt.Errorf("%w: %s is not on the ring", ErrInvalidSnapshot, member)
+		}
+		for vnode := range seen {
+			if vnode >= len(seen) {
+				return fmt.Errorf("%w: virtual nodes of %s are not consecutive", ErrInvalidSnapshot, member)
+			}
+		}
+	}
+	return nil
+}
+
+// validateBuckets checks that every member owns exactly as many jump buckets as its weight
+func (s *Snapshot) validateBuckets() error {
+	buckets := make(map[string]int, len(s.Members))
+	for _, member := range s.Members {
+		buckets[member.Address] = 0
+	}
+	for idx, member := range s.Buckets {
+		if _, ok := buckets[member]; !ok {
+			return fmt.Errorf("%w: bucket %d of unknown member %s", ErrInvalidSnapshot, idx, member)
+		}
+		buckets[member]++
+	}
+	for _, member := range s.Members {
+		if buckets[member.Address] != member.Weight {
+			return fmt.Errorf("%w: %s of weight %d owns %d buckets", ErrInvalidSnapshot, member.Address, member.Weight, buckets[member.Address])
+		}
+	}
+	return nil
+}
+
+// memberStates groups the positions and buckets of a valid snapshot by member, in virtual node order, for restoreView
+func (s *Snapshot) memberStates() []MemberState {
+	states := make([]MemberState, len(s.Members))
+	index := make(map[string]int, len(s.Members))
+	for i, member := range s.Members {
+		states[i] = MemberState{Address: member.Address, Weight: member.Weight}
+		index[member.Address] = i
+	}
+	for _, position := range s.Positions {
+		state := &states[index[position.Member]]
+		for len(state.Positions) <= position.VNode {
+			state.Positions = append(state.Positions, 0)
+		}
+		state.Positions[position.VNode] = position.Position
+	}
+	for idx, member := range s.Buckets {
+		state := &states[index[member]]
+		state.Buckets = append(state.Buckets, idx)
+	}
+	return states
+}
+
+/*
+MarshalBinary encodes a valid snapshot as the magic bytes "CHSN" followed by unsigned varints: the version, the epoch,
+the partitioner, the raw fingerprint, the ring size, the replication factor, every member's address and weight, and
+every position as its distance from the previous one along with the index of its member and its virtual node, and the
+index of the member of every bucket. Strings and lists are prefixed with their length.
+*/
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	fingerprint, err := hex.DecodeString(s.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	putUvarint := func(x uint64) {
+		var scratch [binary.MaxVarintLen64]byte
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], x)])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+
+	putUvarint(uint64(s.Version))
+	putUvarint(s.Epoch)
+	putBytes([]byte(s.Partitioner))
+	putBytes(fingerprint)
+	putUvarint(s.RingSize)
+	putUvarint(uint64(s.ReplicationFactor))
+	index := make(map[string]int, len(s.Members))
+	putUvarint(uint64(len(s.Members)))
+	for i, member := range s.Members {
+		index[member.Address] = i
+		putBytes([]byte(member.Address))
+		putUvarint(uint64(member.Weight))
+	}
+	putUvarint(uint64(len(s.Positions)))
+	var previous uint64
+	for _, position := range s.Positions {
+		putUvarint(position.Position - previous)
+		putUvarint(uint64(index[position.Member]))
+		putUvarint(uint64(position.VNode))
+		previous = position.Position
+	}
+	putUvarint(uint64(len(s.Buckets)))
+	for _, member := range s.Buckets {
+		putUvarint(uint64(index[member]))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary encoded, the decoded snapshot still has to be validated before it is used
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return fmt.Errorf("%w: not a binary snapshot", ErrInvalidSnapshot)
+	}
+	reader := bytes.NewReader(data[len(snapshotMagic):])
+	var err error
+	getUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var x uint64
+		x, err = binary.ReadUvarint(reader)
+		return x
+	}
+	getInt := func() int {
+		x := getUvarint()
+		if err == nil && x > uint64(maxInt) {
+			err = fmt.Errorf("%w: %d out of range", ErrInvalidSnapshot, x)
+		}
+		return int(x)
+	}
+	getBytes := func() []byte {
+		n := getUvarint()
+		if err != nil {
+			return nil
+		}
+		if n > uint64(reader.Len()) {
+			err = io.ErrUnexpectedEOF
+			return nil
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(reader, b)
+		return b
+	}
+
+	decoded := Snapshot{}
+	decoded.Version = getInt()
+	if err == nil && decoded.Version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, decoded.Version)
+	}
+	decoded.Epoch = getUvarint()
+	decoded.Partitioner = string(getBytes())
+	decoded.Fingerprint = hex.EncodeToString(getBytes())
+	decoded.RingSize = getUvarint()
+	decoded.ReplicationFactor = getInt()
+	members := getInt()
+	for i := 0; i < members && err == nil; i++ {
+		decoded.Members = append(decoded.Members, SnapshotMember{Address: string(getBytes()), Weight: getInt()})
+	}
+	positions := getInt()
+	var previous uint64
+	for i := 0; i < positions && err == nil; i++ {
+		position := SnapshotPosition{Position: previous + getUvarint()}
+		member := getInt()
+		position.VNode = getInt()
+		if err == nil && member >= len(decoded.Members) {
+			err = fmt.Errorf("%w: position %d of unknown member %d", ErrInvalidSnapshot, position.Position, member)
+		}
+		if err != nil {
+			break
+		}
+		position.Member = decoded.Members[member].Address
+		decoded.Positions = append(decoded.Positions, position)
+		previous = position.Position
+	}
+	buckets := getInt()
+	for i := 0; i < buckets && err == nil; i++ {
+		member := getInt()
+		if err == nil && member >= len(decoded.Members) {
+			err = fmt.Errorf("%w: bucket %d of unknown member %d", ErrInvalidSnapshot, i, member)
+		}
+		if err != nil {
+			break
+		}
+		decoded.Buckets = append(decoded.Buckets, decoded.Members[member].Address)
+	}
+	if err != nil {
+		return err
+	}
+	if reader.Len() > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidSnapshot, reader.Len())
+	}
+	*s = decoded
+	return nil
+}
+
+// maxInt bounds the integers a binary snapshot can decode into
+const maxInt = int(^uint(0) >> 1)
+
+/*
+Import replaces the membership with the one in s, which has to be valid, come from a proxy configured with the same
+placement and replication factor and be at least as recent as the membership it replaces. No keys are moved, Import is
+meant for bringing an instance in line with the proxy the snapshot was taken from, not for changing membership. In
+bounded load mode it fails with ErrBoundedLoadState, as the assignments of keys would be lost.
+*/
+func (ch *ConsistentHashing) Import(s *Snapshot) error {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.load(s)
+}
+
+// load makes the membership in s the one lookups see, ch has to be locked
+func (ch *ConsistentHashing) load(s *Snapshot) error {
+	if ch.capacityFactor > 0 {
+		return ErrBoundedLoadState
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	// a different replication factor places keys the same way but disagrees on their preference lists
+	if s.Partitioner != ch.partitioner.Name() || s.Fingerprint != ch.fingerprint() || s.ReplicationFactor != ch.replicas {
+		return ErrConfigMismatch
+	}
+	if s.Epoch < ch.current.Load().epoch {
+		return ErrStaleEpoch
+	}
+
+	v, err := ch.restoreView(s.memberStates(), s.Epoch)
+	if err != nil {
+		return err
+	}
+	ch.writeMu.Lock()
+	ch.current.Store(v)
+	ch.writeMu.Unlock()
+	ch.saveState()
+	return nil
+}
@@ -0,0 +1,147 @@
+package consistenthashing
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func snapshotCluster(t *testing.T) *ConsistentHashing {
+	ch := newTestConsistentHashing(WithVirtualNodes(8), WithReplicationFactor(2), WithTransferer(NewMemoryTransferer()))
+	for member, weight := range map[string]int{"node-a:1": 1, "node-b:1": 3, "node-c:1": 2} {
+		if err := ch.AddMemberWithWeight(member, weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ch
+}
+
+func TestSnapshot_RoundTripsAndImports(t *testing.T) {
+	ch := snapshotCluster(t)
+	snapshot := ch.Snapshot()
+	if err := snapshot.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Positions) != 8*(1+3+2) {
+		t.Errorf("expected every virtual node in the snapshot, got %d", len(snapshot.Positions))
+	}
+
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Snapshot
+	if err := json.Unmarshal(buf, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := snapshot.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBinary Snapshot
+	if err := fromBinary.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fromJSON, snapshot) || !reflect.DeepEqual(&fromBinary, snapshot) {
+		t.Fatalf("snapshot changed in encoding:\n%+v\n%+v\n%+v", snapshot, fromJSON, fromBinary)
+	}
+	if len(bin) >= len(buf) {
+		t.Errorf("expected the binary snapshot to be smaller than JSON, got %d and %d bytes", len(bin), len(buf))
+	}
+
+	imported := newTestConsistentHashing(WithVirtualNodes(8), WithReplicationFactor(2))
+	if err := imported.Import(&fromBinary); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Epoch() != ch.Epoch() {
+		t.Errorf("expected epoch %d, got %d", ch.Epoch(), imported.Epoch())
+	}
+	for _, key := range testKeys(200) {
+		want, _ := ch.GetShards(key)
+		got, _ := imported.GetShards(key)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s routed to %v instead of %v", key, got, want)
+		}
+	}
+	if !reflect.DeepEqual(imported.Snapshot(), snapshot) {
+		t.Errorf("expected the imported ring to export the same snapshot")
+	}
+}
+
+func TestSnapshot_ValidateRejectsBrokenRings(t *testing.T) {
+	broken := map[string]func(s *Snapshot){
+		"duplicate address": func(s *Snapshot) {
+			s.Members = append(s.Members, s.Members[0])
+		},
+		"unsorted positions": func(s *Snapshot) {
+			s.Positions[1], s.Positions[2] = s.Positions[2], s.Positions[1]
+		},
+		"duplicate position": func(s *Snapshot) {
+			s.Positions[1].Position = s.Positions[0].Position
+		},
+		"position off the ring": func(s *Snapshot) {
+			s.Positions[len(s.Positions)-1].Position = s.RingSize
+		},
+		"unknown member": func(s *Snapshot) {
+			s.Positions[0].Member = "node-z:1"
+		},
+		"missing virtual node": func(s *Snapshot) {
+			s.Positions = s.Positions[1:]
+		},
+		"member off the ring": func(s *Snapshot) {
+			s.Members = append(s.Members, SnapshotMember{Address: "node-z:1", Weight: 1})
+		},
+		"unsupported version": func(s *Snapshot) {
+			s.Version++
+		},
+	}
+	for name, breakSnapshot := range broken {
+		snapshot := snapshotCluster(t).Snapshot()
+		breakSnapshot(snapshot)
+		if err := snapshot.Validate(); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("expected a snapshot with a %s to be rejected, got %v", name, err)
+		}
+		if _, err := snapshot.MarshalBinary(); err == nil {
+			t.Errorf("expected a snapshot with a %s not to encode", name)
+		}
+	}
+}
+
+func TestSnapshot_ImportRefusesIncompatibleSnapshots(t *testing.T) {
+	snapshot := snapshotCluster(t).Snapshot()
+
+	other := newTestConsistentHashing(WithVirtualNodes(4))
+	if err := other.Import(snapshot); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected a snapshot of another configuration to be refused, got %v", err)
+	}
+	unreplicated := newTestConsistentHashing(WithVirtualNodes(8))
+	if err := unreplicated.Import(snapshot); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected a snapshot of another replication factor to be refused, got %v", err)
+	}
+
+	bounded := newTestConsistentHashing(WithVirtualNodes(8), WithReplicationFactor(2), WithBoundedLoad(1.25))
+	if err := bounded.Import(snapshot); !errors.Is(err, ErrBoundedLoadState) {
+		t.Errorf("expected importing in bounded load mode to be refused, got %v", err)
+	}
+	if len(bounded.Snapshot().Members) != 0 {
+		t.Errorf("expected nothing imported in bounded load mode")
+	}
+
+	ahead := snapshotCluster(t)
+	if err := ahead.AddMember("node-d:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ahead.Import(snapshot); !errors.Is(err, ErrStaleEpoch) {
+		t.Errorf("expected an older snapshot to be refused, got %v", err)
+	}
+
+	bin, err := snapshot.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var truncated Snapshot
+	if err := truncated.UnmarshalBinary(bin[:len(bin)-1]); err == nil {
+		t.Errorf("expected a truncated binary snapshot to be rejected")
+	}
+}
@@ -0,0 +1,122 @@
+package consistenthashing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hamdaankhalid/consistenthashing/internal/atomicfile"
+	"log"
+	"os"
+)
+
+// ErrConfigMismatch refuses to load a ring saved or exported by a proxy placing or replicating keys differently
+var ErrConfigMismatch = errors.New("the ring was placed with a different hash configuration or replication factor")
+
+// ErrBoundedLoadState refuses to load a ring in bounded load mode, as the assignments of keys are not part of it
+var ErrBoundedLoadState = errors.New("bounded load assignments are not saved with the ring, restoring it would remap keys")
+
+/*
+WithStateFile saves the membership to path every time it settles, so that Restore can pick up where a restarted proxy
+left off. The file is replaced atomically, a crash leaves either the previous membership or the new one behind. Only
+the membership is saved, so it cannot be combined with WithBoundedLoad: keys that spilled past their primary would be
+assigned again in whatever order they are looked up after the restart, and Restore refuses to run.
+*/
+func WithStateFile(path string) Option {
+	return func(ch *ConsistentHashing) {
+		ch.stateFile = path
+	}
+}
+
+/*
+fingerprint identifies the hash configuration of the empty placement: for the ring its size, its virtual nodes and
+where a fixed set of probes hash to, for any other placement where probe keys land once probe members are added. Two
+placements with the same fingerprint place members and keys the same way, whatever the hash function is called.
+*/
+func (ch *ConsistentHashing) fingerprint() string {
+	ch.fingerprintOnce.Do(func() {
+		digest := sha256.New()
+		_, _ = fmt.Fprintf(digest, "%s", ch.partitioner.Name())
+		if r, ok := ch.partitioner.(*ring); ok {
+			_, _ = fmt.Fprintf(digest, "|%d|%d", r.size, r.vnodes)
+			for i := 0; i < 64; i++ {
+				_, _ = fmt.Fprintf(digest, "|%d", r.position(fmt.Sprintf("probe-%d", i)))
+			}
+		} else {
+			placement := ch.partitioner
+			for i := 0; i < 4; i++ {
+				next, err := placement.Add(fmt.Sprintf("probe-member-%d", i), 1)
+				if err != nil {
+					break
+				}
+				placement = next
+			}
+			for i := 0; i < 64; i++ {
+				_, _ = fmt.Fprintf(digest, "|%v", placement.Locate(fmt.Sprintf("probe-%d", i), 4))
+			}
+		}
+		ch.fingerprintValue = hex.EncodeToString(digest.Sum(nil))
+	})
+	return ch.fingerprintValue
+}
+
+/*
+saveState writes the current membership to the state file, through a temporary file that is synced and renamed over it.
+Membership changes call it once the membership settled, before the journal marks the migration finished, so a proxy
+crashing in between finds the migration to recover rather than a state file that is behind the keys.
+*/
+func (ch *ConsistentHashing) saveState() {
+	if ch.stateFile == "" {
+		return
+	}
+	if err := writeState(ch.stateFile, ch.snapshot(ch.current.Load())); err != nil {
+		log.Printf("Could not save the ring to %s: %v \n", ch.stateFile, err)
+	}
+}
+
+func writeState(path string, snapshot *Snapshot) error {
+	buf, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, buf)
+}
+
+/*
+Restore places the members saved in the state file again, at the epoch they were saved at, and reports whether there
+was anything to restore. It has to run before any member is added and before Recover, which then settles a migration
+the saved membership did not live to see finished. A ring saved by a proxy configured with another partitioner, hash
+function, ring size or number of virtual nodes is refused with ErrConfigMismatch, as its keys would all be looked up
+in the wrong place, and so is one saved with another replication factor. In bounded load mode it fails with
+ErrBoundedLoadState, even with no state file saved yet.
+*/
+func (ch *ConsistentHashing) Restore() (bool, error) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	if ch.stateFile == "" {
+		return false, nil
+	}
+	if ch.capacityFactor > 0 {
+		return false, ErrBoundedLoadState
+	}
+	buf, err := os.ReadFile(ch.stateFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(buf, &snapshot); err != nil {
+		return false, err
+	}
+	if len(ch.current.Load().weights) > 0 {
+		return false, errors.New("members were added before restoring the ring")
+	}
+	if err := ch.load(&snapshot); err != nil {
+		return false, err
+	}
+	return true, nil
+}
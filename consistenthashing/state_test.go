@@ -0,0 +1,148 @@
+package consistenthashing
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestState_RestoresRingAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring.json")
+	ch, transferer := newMemoryCluster(t, testKeys(50), WithStateFile(path))
+	if err := ch.AddMemberWithWeight("node-b:1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddMember("node-c:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.RemoveMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestConsistentHashing(WithVirtualNodes(8), WithTransferer(transferer), WithStateFile(path))
+	restored, err := restarted.Restore()
+	if err != nil || !restored {
+		t.Fatalf("expected the ring to be restored, got %t %v", restored, err)
+	}
+	if restarted.Epoch() != ch.Epoch() {
+		t.Errorf("expected epoch %d, got %d", ch.Epoch(), restarted.Epoch())
+	}
+	for _, member := range []string{"node-b:1", "node-c:1"} {
+		if !reflect.DeepEqual(restarted.Positions(member), ch.Positions(member)) {
+			t.Errorf("%s moved from %v to %v", member, ch.Positions(member), restarted.Positions(member))
+		}
+	}
+	for _, key := range testKeys(50) {
+		want, _ := ch.GetShards(key)
+		got, _ := restarted.GetShards(key)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s routed to %v instead of %v", key, got, want)
+		}
+	}
+}
+
+func TestState_RefusesChangedHashConfiguration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring.json")
+	ch := newTestConsistentHashing(WithVirtualNodes(8), WithTransferer(NewMemoryTransferer()), WithStateFile(path))
+	if err := ch.AddMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	murmur, err := HashFunc(Murmur3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump, err := NewPartitioner(JumpPartitioner, testHash, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := map[string]*ConsistentHashing{
+		"hash function": New("/keys", "/key", "/key", "/key", murmur, 1000003, WithVirtualNodes(8), WithStateFile(path)),
+		"ring size":     New("/keys", "/key", "/key", "/key", testHash, 360, WithVirtualNodes(8), WithStateFile(path)),
+		"vnodes":        newTestConsistentHashing(WithVirtualNodes(4), WithStateFile(path)),
+		"partitioner":   newTestConsistentHashing(WithPartitioner(jump), WithStateFile(path)),
+	}
+	for name, restarted := range changed {
+		if _, err := restarted.Restore(); !errors.Is(err, ErrConfigMismatch) {
+			t.Errorf("expected a changed %s to be refused, got %v", name, err)
+		}
+		if len(restarted.Positions("node-a:1")) != 0 {
+			t.Errorf("expected nothing restored with a changed %s", name)
+		}
+	}
+}
+
+func TestState_RefusesBoundedLoad(t *testing.T) {
+	ch := newTestConsistentHashing(WithBoundedLoad(1.25), WithStateFile(filepath.Join(t.TempDir(), "ring.json")))
+	if _, err := ch.Restore(); !errors.Is(err, ErrBoundedLoadState) {
+		t.Errorf("expected restoring in bounded load mode to be refused, got %v", err)
+	}
+}
+
+func TestState_NothingToRestore(t *testing.T) {
+	ch := newTestConsistentHashing(WithStateFile(filepath.Join(t.TempDir(), "ring.json")))
+	restored, err := ch.Restore()
+	if err != nil || restored || ch.Epoch() != 0 {
+		t.Fatalf("expected an empty cluster, got %t %v at epoch %d", restored, err, ch.Epoch())
+	}
+}
+
+func TestState_RestoresEveryPartitioner(t *testing.T) {
+	for _, name := range []string{RingPartitioner, JumpPartitioner, RendezvousPartitioner, MaglevPartitioner, MultiProbePartitioner} {
+		path := filepath.Join(t.TempDir(), "ring.json")
+		newCluster := func() *ConsistentHashing {
+			partitioner, err := NewPartitioner(name, testHash, 1000003, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newTestConsistentHashing(WithPartitioner(partitioner), WithTransferer(NewMemoryTransferer()), WithStateFile(path))
+		}
+
+		// placements that depend on history, like jump's buckets, only come back if that history was recorded
+		ch := newCluster()
+		for _, member := range []string{"node-c:1", "node-a:1", "node-d:1", "node-b:1"} {
+			if err := ch.AddMemberWithWeight(member, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ch.RemoveMember("node-a:1"); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newCluster()
+		if _, err := restarted.Restore(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		bin, err := ch.Snapshot().MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decoded Snapshot
+		if err := decoded.UnmarshalBinary(bin); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		imported := newCluster()
+		if err := imported.Import(&decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		recovered, err := ch.restoreView(memberStates(ch.current.Load()), ch.Epoch())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		moved := 0
+		for _, key := range testKeys(500) {
+			want, _ := ch.GetShards(key)
+			restartedShards, _ := restarted.GetShards(key)
+			importedShards, _ := imported.GetShards(key)
+			if !reflect.DeepEqual(want, restartedShards) || !reflect.DeepEqual(want, importedShards) ||
+				!reflect.DeepEqual(want, recovered.placement.Locate(key, ch.replicas)) {
+				moved++
+			}
+		}
+		if moved > 0 {
+			t.Errorf("%s: %d of 500 keys routed elsewhere after restoring", name, moved)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package consistenthashing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithParallelism moves at most n keys at a time, the default is 16
+func WithParallelism(n int) Option {
+	return func(ch *ConsistentHashing) {
+		if n > 0 {
+			ch.parallelism = n
+		}
+	}
+}
+
+/*
+WithThrottle caps how fast keys move during a migration, at keysPerSecond keys copied and bytesPerSecond bytes stored
+on their new owners. A rate of 0 leaves that side unthrottled.
+*/
+func WithThrottle(keysPerSecond float64, bytesPerSecond float64) Option {
+	return func(ch *ConsistentHashing) {
+		ch.keysThrottle = newThrottle(keysPerSecond)
+		ch.bytesThrottle = newThrottle(bytesPerSecond)
+	}
+}
+
+/*
+throttle spaces out units of work to a steady rate per second. Every call books its units right after the ones booked
+before it and sleeps until its turn, so a large value only delays the calls that come after it instead of being
+refused.
+*/
+type throttle struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+// newThrottle returns nil, which never waits, for rates that are not positive
+func newThrottle(rate float64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &throttle{rate: rate}
+}
+
+func (t *throttle) wait(units int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	turn := t.next
+	t.next = t.next.Add(time.Duration(float64(units) / t.rate * float64(time.Second)))
+	t.mu.Unlock()
+
+	time.Sleep(time.Until(turn))
+}
+
+// newTransferClient is shared by every transfer of the default Transferer, keeping enough idle connections per node
+// around for every worker to reuse one
+func newTransferClient(parallelism int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = parallelism
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
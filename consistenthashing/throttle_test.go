@@ -0,0 +1,95 @@
+package consistenthashing
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowTransferer delays every fetch and records how many ran at once
+type slowTransferer struct {
+	*MemoryTransferer
+	mu              sync.Mutex
+	running, maxRan int
+}
+
+func (t *slowTransferer) Fetch(member string, key string) ([]byte, error) {
+	t.mu.Lock()
+	t.running++
+	if t.running > t.maxRan {
+		t.maxRan = t.running
+	}
+	t.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	t.mu.Lock()
+	t.running--
+	t.mu.Unlock()
+	return t.MemoryTransferer.Fetch(member, key)
+}
+
+func TestConsistentHashing_MigrationParallelism(t *testing.T) {
+	transferer := &slowTransferer{MemoryTransferer: NewMemoryTransferer()}
+	ch := newTestConsistentHashing(WithVirtualNodes(8), WithTransferer(transferer), WithParallelism(4))
+	if err := ch.AddMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range testKeys(200) {
+		_ = transferer.Store("node-a:1", key, []byte("val"))
+	}
+
+	if err := ch.AddMember("node-b:1"); err != nil {
+		t.Fatal(err)
+	}
+	if transferer.maxRan > 4 || transferer.maxRan < 2 {
+		t.Errorf("expected between 2 and 4 keys to move at once, got %d", transferer.maxRan)
+	}
+}
+
+func TestConsistentHashing_MigrationThrottle(t *testing.T) {
+	transferer := NewMemoryTransferer()
+	ch := newTestConsistentHashing(WithTransferer(transferer), WithThrottle(0, 10000))
+	if err := ch.AddMember("node-a:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range testKeys(200) {
+		_ = transferer.Store("node-a:1", key, make([]byte, 100))
+	}
+
+	start := time.Now()
+	if err := ch.AddMember("node-b:1"); err != nil {
+		t.Fatal(err)
+	}
+	moved := len(transferer.Keys("node-b:1"))
+	// the first key goes through right away, every other one waits for its 100 bytes at 10000 bytes a second
+	minimum := time.Duration(moved-1) * 10 * time.Millisecond
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("expected moving %d keys to take at least %s, took %s", moved, minimum, elapsed)
+	}
+}
+
+func TestThrottle_Rate(t *testing.T) {
+	if newThrottle(0) != nil {
+		t.Error("expected no throttle without a rate")
+	}
+	var unthrottled *throttle
+	unthrottled.wait(1000)
+
+	limit := newThrottle(200)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				limit.wait(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected 20 units at 200 a second to take about 100ms, took %s", elapsed)
+	}
+}
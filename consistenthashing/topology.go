@@ -0,0 +1,174 @@
+package consistenthashing
+
+import (
+	"math"
+	"sort"
+)
+
+// Topology describes the cluster as lookups currently see it, the proxy serves it as JSON on /topology
+type Topology struct {
+	// Epoch increases with every membership change
+	Epoch             uint64 `json:"epoch"`
+	Partitioner       string `json:"partitioner"`
+	ReplicationFactor int    `json:"replicationFactor"`
+	// RingSize is the number of positions on the ring, 0 when the ring spans the full 64-bit space or the placement is
+	// not the ring at all
+	RingSize uint64 `json:"ringSize"`
+	// Migrating is set while keys are still moving after the last membership change
+	Migrating bool             `json:"migrating"`
+	Members   []MemberTopology `json:"members"`
+}
+
+// MemberTopology is a single member of the Topology, Positions, Ranges and Share are only known for the ring
+type MemberTopology struct {
+	Address   string   `json:"address"`
+	Weight    int      `json:"weight"`
+	Positions []uint64 `json:"positions,omitempty"`
+	Ranges    []Range  `json:"ranges,omitempty"`
+	// Share is the percentage of the ring covered by Ranges
+	Share float64 `json:"share,omitempty"`
+}
+
+/*
+Range is the half-open range of ring positions (Start, End] a member is the primary owner of, matching getOwner which
+hands a key to the first entry at or after its position. A range with Start greater than End wraps around the end of the
+ring, and one with Start equal to End covers the whole ring.
+*/
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Contains reports whether pos falls within the range
+func (rng Range) Contains(pos uint64) bool {
+	if rng.Start < rng.End {
+		return pos > rng.Start && pos <= rng.End
+	}
+	// wraps around the end of the ring, or covers all of it
+	return pos > rng.Start || pos <= rng.End
+}
+
+// Topology returns the members, their positions and owned ranges and the epoch of the current membership
+func (ch *ConsistentHashing) Topology() *Topology {
+	v := ch.current.Load()
+	topology := &Topology{
+		Epoch:             v.epoch,
+		Partitioner:       v.placement.Name(),
+		ReplicationFactor: ch.replicas,
+		Migrating:         v.migration != nil,
+		Members:           []MemberTopology{},
+	}
+
+	r, isRing := v.placement.(*ring)
+	var owned map[string][]Range
+	if isRing {
+		topology.RingSize = r.size
+		owned = r.ownedRanges()
+	}
+
+	for _, member := range sortedMembers(v.weights) {
+		entry := MemberTopology{Address: member, Weight: v.weights[member]}
+		if isRing {
+			entry.Positions = r.positions(member)
+			entry.Ranges = owned[member]
+			entry.Share = r.share(owned[member])
+		}
+		topology.Members = append(topology.Members, entry)
+	}
+	return topology
+}
+
+// OwnedRanges returns the ranges of ring positions serverAddr is the primary owner of, nil when the member is unknown or
+// the placement is not the ring
+func (ch *ConsistentHashing) OwnedRanges(serverAddr string) []Range {
+	r, ok := ch.current.Load().placement.(*ring)
+	if !ok {
+		return nil
+	}
+	return r.ownedRanges()[serverAddr]
+}
+
+// Shares returns the percentage of the ring every member is the primary owner of, nil when the placement is not the ring
+func (ch *ConsistentHashing) Shares() map[string]float64 {
+	r, ok := ch.current.Load().placement.(*ring)
+	if !ok {
+		return nil
+	}
+	shares := make(map[string]float64)
+	for member, ranges := range r.ownedRanges() {
+		shares[member] = r.share(ranges)
+	}
+	return shares
+}
+
+/*
+ownedRanges returns the ranges every member is the primary owner of, sorted by their end. Consecutive entries of the same
+member, including across the wraparound, are merged into one range.
+*/
+func (r *ring) ownedRanges() map[string][]Range {
+	owned := make(map[string][]Range)
+	n := len(r.partitionsRing)
+	if n == 0 {
+		return owned
+	}
+
+	// start from an entry following another member's, so that no run of entries is split by the wraparound
+	start := 0
+	for start < n && r.partitionsRing[(start+n-1)%n].address == r.partitionsRing[start].address {
+		start++
+	}
+	if start == n {
+		only := r.partitionsRing[0]
+		owned[only.address] = []Range{{Start: only.position, End: only.position}}
+		return owned
+	}
+
+	for i := 0; i < n; {
+		first := (start + i) % n
+		address := r.partitionsRing[first].address
+		for i+1 < n && r.partitionsRing[(start+i+1)%n].address == address {
+			i++
+		}
+		owned[address] = append(owned[address], Range{
+			Start: r.partitionsRing[(first+n-1)%n].position,
+			End:   r.partitionsRing[(start+i)%n].position,
+		})
+		i++
+	}
+
+	for _, ranges := range owned {
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].End < ranges[j].End
+		})
+	}
+	return owned
+}
+
+// length is the number of positions in rng, as a float since the whole 64-bit space does not fit in a uint64
+func (r *ring) length(rng Range) float64 {
+	if rng.Start == rng.End {
+		return r.capacity()
+	}
+	if r.size == 0 {
+		// unsigned subtraction already wraps around the full 64-bit space
+		return float64(rng.End - rng.Start)
+	}
+	return float64((rng.End + r.size - rng.Start) % r.size)
+}
+
+// capacity is the number of positions on the ring
+func (r *ring) capacity() float64 {
+	if r.size == 0 {
+		return math.Exp2(64)
+	}
+	return float64(r.size)
+}
+
+// share is the percentage of the ring covered by ranges
+func (r *ring) share(ranges []Range) float64 {
+	covered := 0.0
+	for _, rng := range ranges {
+		covered += r.length(rng)
+	}
+	return covered / r.capacity() * 100
+}
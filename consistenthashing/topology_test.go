@@ -0,0 +1,144 @@
+package consistenthashing
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestConsistentHashing_RingOwnedRanges(t *testing.T) {
+	testRing := &ring{
+		size: 800,
+		partitionsRing: []*ringMember{
+			{address: "a", position: 20},
+			{address: "b", position: 160},
+			{address: "b", vnode: 1, position: 190},
+			{address: "c", position: 220},
+			{address: "a", vnode: 1, position: 500},
+		},
+	}
+
+	owned := testRing.ownedRanges()
+	// a's two entries meet across the wraparound and merge into one range, as do b's neighbouring entries
+	expected := map[string][]Range{
+		"a": {{Start: 220, End: 20}},
+		"b": {{Start: 20, End: 190}},
+		"c": {{Start: 190, End: 220}},
+	}
+	if !reflect.DeepEqual(owned, expected) {
+		t.Errorf("expected %v, got %v", expected, owned)
+	}
+
+	// every range must agree with getOwner on both of its ends
+	for addr, ranges := range owned {
+		for _, rng := range ranges {
+			for _, pos := range []uint64{(rng.Start + 1) % testRing.size, rng.End} {
+				owner, _ := testRing.getOwner(pos)
+				if owner.address != addr {
+					t.Errorf("position %d is in a range of %s but owned by %s", pos, addr, owner.address)
+				}
+			}
+		}
+	}
+
+	expectedShares := map[string]float64{"a": 75, "b": 21.25, "c": 3.75}
+	for addr, share := range expectedShares {
+		if got := testRing.share(owned[addr]); math.Abs(got-share) > 1e-9 {
+			t.Errorf("expected %s to own %.2f%% of the ring, got %.2f%%", addr, share, got)
+		}
+	}
+
+	single := &ring{size: 800, partitionsRing: []*ringMember{{address: "a", position: 20}, {address: "a", vnode: 1, position: 90}}}
+	if !reflect.DeepEqual(single.ownedRanges()["a"], []Range{{Start: 20, End: 20}}) {
+		t.Errorf("expected a lone member to own the whole ring, got %v", single.ownedRanges())
+	}
+	if single.share(single.ownedRanges()["a"]) != 100 {
+		t.Error("expected a lone member to own 100% of the ring")
+	}
+}
+
+func TestConsistentHashing_Shares(t *testing.T) {
+	for _, ch := range []*ConsistentHashing{
+		newTestConsistentHashing(WithVirtualNodes(8)),
+		newTestConsistentHashing(WithVirtualNodes(8), WithHashSpace64(func(s string) uint64 {
+			return uint64(testHash(s)) << 1
+		})),
+	} {
+		nodes := []*testNode{newTestNode(t), newTestNode(t), newTestNode(t)}
+		for _, node := range nodes {
+			if err := ch.AddMember(node.addr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		shares := ch.Shares()
+		total := 0.0
+		for _, node := range nodes {
+			if shares[node.addr()] <= 0 {
+				t.Errorf("expected %s to own part of the ring", node.addr())
+			}
+			if !reflect.DeepEqual(ch.OwnedRanges(node.addr()), ch.Topology().Members[indexOf(ch.Topology(), node.addr())].Ranges) {
+				t.Errorf("expected OwnedRanges to match the topology of %s", node.addr())
+			}
+			total += shares[node.addr()]
+		}
+		if math.Abs(total-100) > 1e-6 {
+			t.Errorf("expected the shares to add up to 100%%, got %f", total)
+		}
+		if ch.OwnedRanges("unknown:1") != nil {
+			t.Error("expected no ranges for an unknown member")
+		}
+	}
+}
+
+func indexOf(topology *Topology, addr string) int {
+	for i, member := range topology.Members {
+		if member.Address == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestConsistentHashing_Topology(t *testing.T) {
+	ch := newTestConsistentHashing(WithVirtualNodes(4), WithReplicationFactor(2))
+	a, b := newTestNode(t), newTestNode(t)
+
+	topology := ch.Topology()
+	if topology.Epoch != 0 || len(topology.Members) != 0 || topology.Partitioner != RingPartitioner {
+		t.Errorf("unexpected topology of an empty cluster %+v", topology)
+	}
+
+	if err := ch.AddMember(a.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddMemberWithWeight(b.addr(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	topology = ch.Topology()
+	if topology.Epoch != 2 || topology.RingSize != 1000003 || topology.ReplicationFactor != 2 || topology.Migrating {
+		t.Errorf("unexpected topology %+v", topology)
+	}
+	if len(topology.Members) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(topology.Members))
+	}
+	for _, member := range topology.Members {
+		if !reflect.DeepEqual(member.Positions, ch.Positions(member.Address)) {
+			t.Errorf("expected %s to report its resolved positions", member.Address)
+		}
+		if len(member.Positions) != 4*member.Weight {
+			t.Errorf("expected %s to have %d positions, got %d", member.Address, 4*member.Weight, len(member.Positions))
+		}
+		if len(member.Ranges) == 0 {
+			t.Errorf("expected %s to own at least one range", member.Address)
+		}
+	}
+
+	if err := ch.RemoveMember(a.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if topology = ch.Topology(); topology.Epoch != 3 || len(topology.Members) != 1 {
+		t.Errorf("unexpected topology after removing a member %+v", topology)
+	}
+}
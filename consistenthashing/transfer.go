@@ -0,0 +1,221 @@
+package consistenthashing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+/*
+Transferer moves data between members during redistribution. The value Fetch returns is opaque to ConsistentHashing, it
+is only ever handed back to Store on another member, so an implementation is free to carry metadata along with it.
+*/
+type Transferer interface {
+	// ListKeys returns every key member holds
+	ListKeys(member string) ([]string, error)
+	// Fetch reads the value member holds for key
+	Fetch(member string, key string) ([]byte, error)
+	// Store saves a value read by Fetch on member
+	Store(member string, key string, value []byte) error
+	// Delete removes key from member
+	Delete(member string, key string) error
+}
+
+// WithTransferer moves keys through t instead of the HTTP routes passed to New
+func WithTransferer(t Transferer) Option {
+	return func(ch *ConsistentHashing) {
+		ch.transferer = t
+	}
+}
+
+/*
+HTTPTransferer talks to node servers over plain HTTP, the way servers.GetApp expects. Values are the JSON documents
+the get key route answers with, which the add key route accepts as they are.
+*/
+type HTTPTransferer struct {
+	client                                                 *http.Client
+	allKeysRoute, removeKeyRoute, addKeyRoute, getKeyRoute string
+}
+
+// NewHTTPTransferer builds the default Transferer, a nil client falls back to http.DefaultClient
+func NewHTTPTransferer(client *http.Client, allKeysRoute string, removeKeyRoute string, addKeyRoute string, getKeyRoute string) *HTTPTransferer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPTransferer{
+		client:         client,
+		allKeysRoute:   allKeysRoute,
+		removeKeyRoute: removeKeyRoute,
+		addKeyRoute:    addKeyRoute,
+		getKeyRoute:    getKeyRoute,
+	}
+}
+
+func (t *HTTPTransferer) ListKeys(member string) ([]string, error) {
+	resp, err := t.client.Get("http://" + member + t.allKeysRoute)
+	if err != nil {
+		return nil, err
+	}
+	var decodedResp allKeysResponse
+	err = json.NewDecoder(resp.Body).Decode(&decodedResp)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return decodedResp.Keys, nil
+}
+
+func (t *HTTPTransferer) Fetch(member string, key string) ([]byte, error) {
+	getKeyUrl := "http://" + member + t.getKeyRoute + "?key=" + url.QueryEscape(key)
+	resp, err := t.client.Get(getKeyUrl)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get key response unsuccessful got %d for request to %s", resp.StatusCode, getKeyUrl)
+	}
+	return buf, nil
+}
+
+func (t *HTTPTransferer) Store(member string, key string, value []byte) error {
+	resp, err := t.client.Post("http://"+member+t.addKeyRoute, "application/json", bytes.NewBuffer(value))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("post key val response unsuccessful got %d for key %s on %s", resp.StatusCode, key, member)
+	}
+	return nil
+}
+
+func (t *HTTPTransferer) Delete(member string, key string) error {
+	removeUrl := "http://" + member + t.removeKeyRoute + "?key=" + url.QueryEscape(key)
+	req, err := http.NewRequest(http.MethodDelete, removeUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete response unsuccessful got %d on request to %s", resp.StatusCode, removeUrl)
+	}
+	return nil
+}
+
+type allKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// ErrKeyNotFound is returned by Fetch when a member does not hold the requested key
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrInjectedFailure is returned by MemoryTransferer for the calls it was told to fail
+var ErrInjectedFailure = errors.New("injected failure")
+
+// MemoryTransferer keeps every member's keys in memory, standing in for real nodes in tests
+type MemoryTransferer struct {
+	mu     sync.Mutex
+	stores map[string]map[string][]byte
+	// failures counts down the calls left to fail per member and step, negative counts never run out
+	failures map[[2]string]int
+}
+
+func NewMemoryTransferer() *MemoryTransferer {
+	return &MemoryTransferer{stores: make(map[string]map[string][]byte), failures: make(map[[2]string]int)}
+}
+
+// Fail makes the next times calls of op (one of OpList, OpFetch, OpStore or OpDelete) against member fail, every call
+// for a negative times and none for 0
+func (t *MemoryTransferer) Fail(member string, op string, times int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[[2]string{member, op}] = times
+}
+
+// failing reports whether a call of op against member has to fail, t.mu must be held
+func (t *MemoryTransferer) failing(member string, op string) bool {
+	left := t.failures[[2]string{member, op}]
+	if left > 0 {
+		t.failures[[2]string{member, op}] = left - 1
+	}
+	return left != 0
+}
+
+// Keys returns a copy of everything member holds
+func (t *MemoryTransferer) Keys(member string) map[string][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make(map[string][]byte, len(t.stores[member]))
+	for key, value := range t.stores[member] {
+		keys[key] = value
+	}
+	return keys
+}
+
+func (t *MemoryTransferer) ListKeys(member string) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failing(member, OpList) {
+		return nil, ErrInjectedFailure
+	}
+	keys := make([]string, 0, len(t.stores[member]))
+	for key := range t.stores[member] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (t *MemoryTransferer) Fetch(member string, key string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failing(member, OpFetch) {
+		return nil, ErrInjectedFailure
+	}
+	value, ok := t.stores[member][key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *MemoryTransferer) Store(member string, key string, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failing(member, OpStore) {
+		return ErrInjectedFailure
+	}
+	if t.stores[member] == nil {
+		t.stores[member] = make(map[string][]byte)
+	}
+	t.stores[member][key] = value
+	return nil
+}
+
+func (t *MemoryTransferer) Delete(member string, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failing(member, OpDelete) {
+		return ErrInjectedFailure
+	}
+	delete(t.stores[member], key)
+	return nil
+}
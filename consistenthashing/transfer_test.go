@@ -0,0 +1,76 @@
+package consistenthashing
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConsistentHashing_MemoryTransferer(t *testing.T) {
+	transferer := NewMemoryTransferer()
+	ch := newTestConsistentHashing(WithVirtualNodes(8), WithReplicationFactor(2), WithTransferer(transferer))
+	members := []string{"node-a:1", "node-b:1", "node-c:1", "node-d:1"}
+
+	for _, member := range members[:2] {
+		if err := ch.AddMember(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := testKeys(200)
+	for _, key := range keys {
+		shards, _ := ch.GetShards(key)
+		for _, shard := range shards {
+			_ = transferer.Store(shard, key, []byte("val-"+key))
+		}
+	}
+
+	assertMemoryPlacement := func() {
+		t.Helper()
+		for _, key := range keys {
+			shards, _ := ch.GetShards(key)
+			for _, member := range members {
+				value, ok := transferer.Keys(member)[key]
+				if contains(shards, member) != ok {
+					t.Fatalf("expected %s to hold %s only when it is one of its replicas %v", member, key, shards)
+				}
+				if ok && string(value) != "val-"+key {
+					t.Fatalf("unexpected value %q for %s on %s", value, key, member)
+				}
+			}
+		}
+	}
+
+	for _, member := range members[2:] {
+		if err := ch.AddMember(member); err != nil {
+			t.Fatal(err)
+		}
+		assertMemoryPlacement()
+	}
+	if err := ch.RemoveMember(members[0]); err != nil {
+		t.Fatal(err)
+	}
+	assertMemoryPlacement()
+}
+
+func TestConsistentHashing_HTTPTransferer(t *testing.T) {
+	node := newTestNode(t)
+	transferer := NewHTTPTransferer(nil, "/keys", "/key", "/key", "/key")
+	key := "a key&with=symbols"
+
+	if err := transferer.Store(node.addr(), key, []byte(fmt.Sprintf(`{"key":%q,"value":"v"}`, key))); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := transferer.ListKeys(node.addr())
+	if err != nil || !reflect.DeepEqual(keys, []string{key}) {
+		t.Fatalf("expected to list %q, got %v %v", key, keys, err)
+	}
+	if _, err := transferer.Fetch(node.addr(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := transferer.Delete(node.addr(), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transferer.Fetch(node.addr(), key); err == nil {
+		t.Error("expected fetching a deleted key to fail")
+	}
+}
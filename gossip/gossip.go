@@ -0,0 +1,607 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Roles members announce themselves with, only node servers hold keys
+const (
+	RoleNode  = "node"
+	RoleProxy = "proxy"
+)
+
+// Routes the gossip protocol is served on, Register adds them to a router
+const (
+	PingRoute    = "/gossip/ping"
+	PingReqRoute = "/gossip/ping-req"
+	JoinRoute    = "/gossip/join"
+)
+
+// maxPiggyback bounds the updates carried by a single message, retransmitMult scales how often every update is sent
+const (
+	maxPiggyback   = 8
+	retransmitMult = 3
+)
+
+type State int
+
+const (
+	// Alive members answer pings
+	Alive State = iota
+	// Suspect members did not answer a ping, they are declared dead unless they refute it in time
+	Suspect
+	// Dead members stopped answering for good, they only come back by joining with a newer incarnation
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is what the cluster knows about one of its members. Incarnation orders the claims made about it, only the
+// member itself ever raises it, to refute being suspected.
+type Member struct {
+	Address     string `json:"address"`
+	Role        string `json:"role"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+type Config struct {
+	// Address is the host:port other members reach this member's routes at, it doubles as its name in the cluster
+	Address string
+	// Role tells other members what this member is, RoleNode or RoleProxy
+	Role string
+	// Seed is a member to join through, tried every protocol period for as long as no other member is known to be alive
+	Seed string
+	// ProtocolPeriod is how often a member is probed, 1s by default
+	ProtocolPeriod time.Duration
+	// PingTimeout is how long a probed member has to answer before others are asked to reach it, a third of the
+	// protocol period by default
+	PingTimeout time.Duration
+	// IndirectChecks is the number of members asked to reach a member that did not answer, 3 by default
+	IndirectChecks int
+	// SuspicionTimeout is how long a suspect member has to refute it before it is declared dead, 5 protocol periods by
+	// default
+	SuspicionTimeout time.Duration
+	Client           *http.Client
+}
+
+/*
+Node is a member of a SWIM cluster (Das, Gupta and Motivala, "SWIM: Scalable Weakly-consistent Infection-style Process
+Group Membership Protocol") gossiping over HTTP. Every protocol period it pings one member, going round the members in
+a random order, and when no answer comes back in time asks a few others to ping it too. A member nobody reached is
+suspected, and declared dead once the suspicion timeout passes without it refuting. Changes spread by piggybacking on
+pings and their acks, so every member learns of every other one without anything being broadcast.
+*/
+type Node struct {
+	config   Config
+	client   *http.Client
+	onChange func(Member)
+
+	// mu guards everything below
+	mu   sync.Mutex
+	self Member
+	// members holds every other member ever heard of, dead ones included so that stale gossip cannot revive them
+	members    map[string]*member
+	broadcasts []*broadcast
+	probeOrder []string
+	probeIndex int
+	changes    []Member
+	changed    chan struct{}
+	stopped    bool
+	stop       chan struct{}
+	wg         sync.WaitGroup
+
+	// lastJoinErr is only used by run, to log a seed that cannot be joined once rather than every period
+	lastJoinErr error
+}
+
+type member struct {
+	Member
+	suspectedAt time.Time
+}
+
+// broadcast is an update waiting to be piggybacked, until it was sent often enough to have reached everyone
+type broadcast struct {
+	update    Member
+	transmits int
+}
+
+func New(config Config) *Node {
+	if config.ProtocolPeriod <= 0 {
+		config.ProtocolPeriod = time.Second
+	}
+	if config.PingTimeout <= 0 || config.PingTimeout >= config.ProtocolPeriod {
+		config.PingTimeout = config.ProtocolPeriod / 3
+	}
+	if config.IndirectChecks <= 0 {
+		config.IndirectChecks = 3
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = 5 * config.ProtocolPeriod
+	}
+	n := &Node{
+		config:  config,
+		client:  config.Client,
+		members: make(map[string]*member),
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		// a restarted member has to outrank whatever the cluster remembers about its previous run
+		self: Member{Address: config.Address, Role: config.Role, State: Alive, Incarnation: uint64(time.Now().UnixNano())},
+	}
+	if n.client == nil {
+		n.client = &http.Client{}
+	}
+	return n
+}
+
+// Register serves the gossip protocol on r
+func (n *Node) Register(r *mux.Router) {
+	r.HandleFunc(PingRoute, n.handlePing).Methods(http.MethodPost)
+	r.HandleFunc(PingReqRoute, n.handlePingReq).Methods(http.MethodPost)
+	r.HandleFunc(JoinRoute, n.handleJoin).Methods(http.MethodPost)
+}
+
+// Start sets the node off probing, onChange, when set, is called in order with every change of another member's state
+func (n *Node) Start(onChange func(Member)) {
+	n.onChange = onChange
+	n.wg.Add(2)
+	go n.run()
+	go n.dispatch()
+}
+
+// Stop stops taking part in the cluster, as if the member had died, and waits for the node's goroutines to return
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// Done is closed once the node is stopped
+func (n *Node) Done() <-chan struct{} {
+	return n.stop
+}
+
+// Members returns every other member ever heard of, sorted by address
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		members = append(members, m.Member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Address < members[j].Address
+	})
+	return members
+}
+
+// Join asks seed for every member it knows and announces this member to the cluster through it
+func (n *Node) Join(seed string) error {
+	n.mu.Lock()
+	self := n.self
+	n.mu.Unlock()
+
+	var reply joinReply
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ProtocolPeriod)
+	defer cancel()
+	if err := n.call(ctx, seed, JoinRoute, joinMessage{Member: self}, &reply); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, update := range reply.Members {
+		n.mergeLocked(update)
+	}
+	log.Printf("Joined gossip cluster through %s, %d members known \n", seed, len(n.members))
+	return nil
+}
+
+// run probes a member every protocol period, and joins the seed for as long as no other member is known to be alive
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.ProtocolPeriod)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		alone := true
+		for _, m := range n.members {
+			alone = alone && m.State == Dead
+		}
+		n.mu.Unlock()
+		if alone && n.config.Seed != "" && n.config.Seed != n.config.Address {
+			err := n.Join(n.config.Seed)
+			if err != nil && n.lastJoinErr == nil {
+				log.Printf("Could not join gossip cluster through %s: %v \n", n.config.Seed, err)
+			}
+			n.lastJoinErr = err
+		} else {
+			n.probe()
+		}
+		n.expireSuspects()
+
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch hands changes to onChange in the order they happened, without holding up the protocol
+func (n *Node) dispatch() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.changed:
+		}
+		n.mu.Lock()
+		changes := n.changes
+		n.changes = nil
+		n.mu.Unlock()
+		for _, change := range changes {
+			if n.onChange != nil {
+				n.onChange(change)
+			}
+		}
+	}
+}
+
+// probe pings the next member, asking others to reach it when it does not answer, and suspects it when nobody did
+func (n *Node) probe() {
+	n.mu.Lock()
+	target := n.nextTargetLocked()
+	n.mu.Unlock()
+	if target == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.PingTimeout)
+	acked := n.ping(ctx, target)
+	cancel()
+	if acked {
+		return
+	}
+
+	n.mu.Lock()
+	helpers := n.helpersLocked(target)
+	n.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), n.config.ProtocolPeriod-n.config.PingTimeout)
+	defer cancel()
+	results := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			results <- n.pingReq(ctx, helper, target)
+		}(helper)
+	}
+	for range helpers {
+		if <-results {
+			return
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m, ok := n.members[target]; ok && m.State == Alive {
+		log.Printf("Suspecting gossip member %s \n", target)
+		suspect := m.Member
+		suspect.State = Suspect
+		n.mergeLocked(suspect)
+	}
+}
+
+// expireSuspects declares dead every member that did not refute being suspected in time
+func (n *Node) expireSuspects() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, m := range n.members {
+		if m.State == Suspect && time.Since(m.suspectedAt) > n.config.SuspicionTimeout {
+			log.Printf("Declaring gossip member %s dead \n", m.Address)
+			dead := m.Member
+			dead.State = Dead
+			n.mergeLocked(dead)
+		}
+	}
+}
+
+// nextTargetLocked goes round every member that is not dead, in an order shuffled anew every round
+func (n *Node) nextTargetLocked() string {
+	for attempts := 0; attempts < 2; attempts++ {
+		for n.probeIndex < len(n.probeOrder) {
+			target := n.probeOrder[n.probeIndex]
+			n.probeIndex++
+			if m, ok := n.members[target]; ok && m.State != Dead {
+				return target
+			}
+		}
+		n.probeOrder = n.probeOrder[:0]
+		for address, m := range n.members {
+			if m.State != Dead {
+				n.probeOrder = append(n.probeOrder, address)
+			}
+		}
+		rand.Shuffle(len(n.probeOrder), func(i, j int) {
+			n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+		})
+		n.probeIndex = 0
+	}
+	return ""
+}
+
+// helpersLocked picks up to IndirectChecks alive members other than target
+func (n *Node) helpersLocked(target string) []string {
+	var candidates []string
+	for address, m := range n.members {
+		if address != target && m.State == Alive {
+			candidates = append(candidates, address)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n.config.IndirectChecks {
+		candidates = candidates[:n.config.IndirectChecks]
+	}
+	return candidates
+}
+
+/*
+mergeLocked applies what update claims about a member, when it is newer than what is known: a higher incarnation always
+wins, and at the same incarnation dead wins over suspect, which wins over alive. A member refutes any claim but alive
+about itself by moving on to a higher incarnation.
+*/
+func (n *Node) mergeLocked(update Member) {
+	if update.Address == n.self.Address {
+		if update.State != Alive && update.Incarnation >= n.self.Incarnation {
+			n.self.Incarnation = update.Incarnation + 1
+			log.Printf("Refuting being %s at incarnation %d \n", update.State, n.self.Incarnation)
+			n.queueLocked(n.self)
+		}
+		return
+	}
+
+	current, known := n.members[update.Address]
+	if known && !supersedes(update, current.Member) {
+		return
+	}
+	if !known {
+		current = &member{}
+		n.members[update.Address] = current
+	}
+	previous := current.State
+	current.Member = update
+	if update.State == Suspect && (!known || previous != Suspect) {
+		current.suspectedAt = time.Now()
+	}
+	n.queueLocked(update)
+
+	if !known || previous != update.State {
+		n.changes = append(n.changes, update)
+		select {
+		case n.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func supersedes(update Member, current Member) bool {
+	if update.Incarnation != current.Incarnation {
+		return update.Incarnation > current.Incarnation
+	}
+	return update.State > current.State
+}
+
+// queueLocked schedules update to be piggybacked, replacing any older update about the same member
+func (n *Node) queueLocked(update Member) {
+	for _, b := range n.broadcasts {
+		if b.update.Address == update.Address {
+			b.update, b.transmits = update, 0
+			return
+		}
+	}
+	n.broadcasts = append(n.broadcasts, &broadcast{update: update})
+}
+
+// piggybackLocked picks the updates sent the fewest times to go out with a message, dropping those sent often enough
+func (n *Node) piggybackLocked() []Member {
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(n.members)+2))))
+	sort.SliceStable(n.broadcasts, func(i, j int) bool {
+		return n.broadcasts[i].transmits < n.broadcasts[j].transmits
+	})
+	var updates []Member
+	for _, b := range n.broadcasts {
+		if len(updates) == maxPiggyback {
+			break
+		}
+		updates = append(updates, b.update)
+		b.transmits++
+	}
+	kept := n.broadcasts[:0]
+	for _, b := range n.broadcasts {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	n.broadcasts = kept
+	return updates
+}
+
+// mergeAll applies updates received from another member
+func (n *Node) mergeAll(updates []Member) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, update := range updates {
+		n.mergeLocked(update)
+	}
+}
+
+func (n *Node) piggyback() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.piggybackLocked()
+}
+
+type pingMessage struct {
+	From    string   `json:"from"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+type pingReqMessage struct {
+	From    string   `json:"from"`
+	Target  string   `json:"target"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+type ackMessage struct {
+	// Acked is set when a ping-req reached its target, a direct ping is acked by answering at all
+	Acked   bool     `json:"acked"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+type joinMessage struct {
+	Member Member `json:"member"`
+}
+
+type joinReply struct {
+	Members []Member `json:"members"`
+}
+
+// ping reports whether target answered a ping before ctx was done
+func (n *Node) ping(ctx context.Context, target string) bool {
+	var ack ackMessage
+	if err := n.call(ctx, target, PingRoute, pingMessage{From: n.config.Address, Updates: n.piggyback()}, &ack); err != nil {
+		return false
+	}
+	n.mergeAll(ack.Updates)
+	return true
+}
+
+// pingReq reports whether helper reached target on this member's behalf before ctx was done
+func (n *Node) pingReq(ctx context.Context, helper string, target string) bool {
+	var ack ackMessage
+	message := pingReqMessage{From: n.config.Address, Target: target, Updates: n.piggyback()}
+	if err := n.call(ctx, helper, PingReqRoute, message, &ack); err != nil {
+		return false
+	}
+	n.mergeAll(ack.Updates)
+	return ack.Acked
+}
+
+// running answers 503 for a stopped node, which should look dead to the rest of the cluster
+func (n *Node) running(writer http.ResponseWriter) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (n *Node) handlePing(writer http.ResponseWriter, request *http.Request) {
+	if !n.running(writer) {
+		return
+	}
+	var message pingMessage
+	if err := json.NewDecoder(request.Body).Decode(&message); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mergeAll(message.Updates)
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(ackMessage{Acked: true, Updates: n.piggyback()})
+}
+
+func (n *Node) handlePingReq(writer http.ResponseWriter, request *http.Request) {
+	if !n.running(writer) {
+		return
+	}
+	var message pingReqMessage
+	if err := json.NewDecoder(request.Body).Decode(&message); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mergeAll(message.Updates)
+	ctx, cancel := context.WithTimeout(request.Context(), n.config.PingTimeout)
+	acked := n.ping(ctx, message.Target)
+	cancel()
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(ackMessage{Acked: acked, Updates: n.piggyback()})
+}
+
+func (n *Node) handleJoin(writer http.ResponseWriter, request *http.Request) {
+	if !n.running(writer) {
+		return
+	}
+	var message joinMessage
+	if err := json.NewDecoder(request.Body).Decode(&message); err != nil || message.Member.Address == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	joiner := message.Member
+	joiner.State = Alive
+	n.mergeLocked(joiner)
+	reply := joinReply{Members: []Member{n.self}}
+	for _, m := range n.members {
+		if m.Address != joiner.Address {
+			reply.Members = append(reply.Members, m.Member)
+		}
+	}
+	n.mu.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(reply)
+}
+
+// call sends message to member and decodes its answer
+func (n *Node) call(ctx context.Context, member string, route string, message interface{}, reply interface{}) error {
+	buf, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+member+route, bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gossip %s to %s unsuccessful got %d", route, member, resp.StatusCode)
+	}
+	return err
+}
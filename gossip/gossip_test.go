@@ -0,0 +1,136 @@
+package gossip
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMember is a gossip node served on localhost, recording every change it was told about
+type testMember struct {
+	node    *Node
+	server  *httptest.Server
+	mu      sync.Mutex
+	changes []string
+}
+
+func newTestMember(t *testing.T, seed string) *testMember {
+	m := &testMember{}
+	var handler http.Handler
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(m.server.Close)
+	m.node = New(Config{
+		Address:          strings.TrimPrefix(m.server.URL, "http://"),
+		Role:             RoleNode,
+		Seed:             seed,
+		ProtocolPeriod:   30 * time.Millisecond,
+		PingTimeout:      10 * time.Millisecond,
+		SuspicionTimeout: 150 * time.Millisecond,
+	})
+	r := mux.NewRouter()
+	m.node.Register(r)
+	handler = r
+	m.node.Start(func(change Member) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.changes = append(m.changes, change.Address+" "+change.State.String())
+	})
+	t.Cleanup(m.node.Stop)
+	return m
+}
+
+// waitFor waits for every member to see every other address in want in the given state
+func waitFor(t *testing.T, members []*testMember, want map[string]State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var missing []string
+		for _, m := range members {
+			states := make(map[string]State)
+			for _, member := range m.node.Members() {
+				states[member.Address] = member.State
+			}
+			for address, state := range want {
+				if got, ok := states[address]; address != m.node.config.Address && (!ok || got != state) {
+					missing = append(missing, fmt.Sprintf("%s sees %s %s", m.node.config.Address, address, got))
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("membership did not converge: %v", missing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGossip_MembersLearnOfEachOtherAndOfFailures(t *testing.T) {
+	seed := newTestMember(t, "")
+	members := []*testMember{seed}
+	for i := 0; i < 4; i++ {
+		members = append(members, newTestMember(t, seed.node.config.Address))
+	}
+	alive := make(map[string]State)
+	for _, m := range members {
+		alive[m.node.config.Address] = Alive
+	}
+	waitFor(t, members, alive)
+
+	failed := members[2]
+	failed.node.Stop()
+	failed.server.Close()
+	survivors := append(append([]*testMember(nil), members[:2]...), members[3:]...)
+	waitFor(t, survivors, map[string]State{failed.node.config.Address: Dead})
+
+	// changes are handed over after the state they report, so they can arrive a little later
+	deadline := time.Now().Add(5 * time.Second)
+	for _, m := range survivors {
+		for {
+			m.mu.Lock()
+			changes := strings.Join(m.changes, ",")
+			m.mu.Unlock()
+			if strings.Contains(changes, failed.node.config.Address+" dead") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s to be told %s died, got %s", m.node.config.Address, failed.node.config.Address, changes)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestGossip_MemberRefutesBeingSuspected(t *testing.T) {
+	n := New(Config{Address: "self:1"})
+	incarnation := n.self.Incarnation
+
+	n.mu.Lock()
+	n.mergeLocked(Member{Address: "self:1", State: Suspect, Incarnation: incarnation})
+	n.mu.Unlock()
+	if n.self.Incarnation != incarnation+1 || n.self.State != Alive {
+		t.Fatalf("expected to refute at incarnation %d, got %+v", incarnation+1, n.self)
+	}
+	updates := n.piggyback()
+	if len(updates) != 1 || updates[0] != n.self {
+		t.Errorf("expected the refutation to be gossiped, got %+v", updates)
+	}
+
+	// older claims never override newer ones
+	n.mu.Lock()
+	n.mergeLocked(Member{Address: "other:1", State: Alive, Incarnation: 5})
+	n.mergeLocked(Member{Address: "other:1", State: Dead, Incarnation: 4})
+	n.mergeLocked(Member{Address: "other:1", State: Suspect, Incarnation: 5})
+	n.mergeLocked(Member{Address: "other:1", State: Alive, Incarnation: 5})
+	n.mu.Unlock()
+	if got := n.Members()[0]; got.State != Suspect || got.Incarnation != 5 {
+		t.Errorf("expected other:1 to be suspect at incarnation 5, got %+v", got)
+	}
+}
@@ -0,0 +1,25 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite_ReplacesWithoutLeavingTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for _, contents := range []string{"first", "second"} {
+		if err := Write(path, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil || string(buf) != contents {
+			t.Fatalf("expected %q, got %q %v", contents, buf, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the file itself to be left, got %v %v", entries, err)
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"encoding/hex"
 	"github.com/gorilla/mux"
 	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"github.com/hamdaankhalid/consistenthashing/gossip"
 	"github.com/hamdaankhalid/consistenthashing/proxy"
+	"github.com/hamdaankhalid/consistenthashing/raft"
 	"github.com/hamdaankhalid/consistenthashing/servers"
 	"github.com/hamdaankhalid/consistenthashing/systemtesting"
-	"hash/fnv"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -25,14 +30,96 @@ go run main.go 8020 proxy
 
 SET-OFF DEMO TEST
 go run main.go test localhost:8020 localhost:8040 localhost:8060 localhost:8080
+
+The proxy keeps CH_REPLICAS copies of every key (N, default 1), and needs CH_READ_QUORUM replicas to agree on a read (R)
+and CH_WRITE_QUORUM replicas to acknowledge a write (W), both defaulting to 1 and neither allowed to exceed N
+CH_REPLICAS=3 CH_READ_QUORUM=2 CH_WRITE_QUORUM=2 go run main.go 8020 proxy
+
+CH_PARTITIONER picks the placement algorithm: ring (default), jump, rendezvous, maglev or multiprobe
+CH_CAPACITY_FACTOR bounds every member's load to that many times its fair share, e.g. 1.25, unbounded when unset
+CH_HASH_SPACE=64 hashes onto the full 64-bit space instead of a 360 position ring
+CH_HASH names the hash function, one of fnv1a32 (default), fnv1a64 (default with CH_HASH_SPACE=64), murmur3, xxhash64,
+siphash, crc32 or sha1. siphash takes its 16 byte key hex encoded from CH_HASH_KEY
+CH_MIGRATION_PARALLELISM moves that many keys at a time when membership changes (default 16), CH_MIGRATION_KEYS_PER_SEC
+and CH_MIGRATION_BYTES_PER_SEC throttle moving them, unthrottled when unset
+CH_JOURNAL keeps a migration journal at that path, a migration the proxy did not live to complete is finished or rolled
+back when it starts again
+CH_STATE saves the ring to that path whenever membership changes, and restores it when the proxy starts again. The proxy
+refuses to start when the saved ring was placed with another partitioner, hash function, ring size or vnodes, and when
+CH_CAPACITY_FACTOR is set as well
+
+RUN SEVERAL PROXIES SHARING ONE RING
+CH_RAFT_PEERS lists the other proxies, which elect a leader through raft. Only the leader changes membership and moves
+keys, the others forward membership requests to it. CH_RAFT_ADDRESS is the address the others reach this proxy at
+(default localhost:<port>), CH_RAFT_STATE keeps its raft log at that path. It cannot be combined with
+CH_CAPACITY_FACTOR, as every proxy would assign keys that spill over in its own way
+CH_RAFT_PEERS=localhost:8021,localhost:8022 go run main.go 8020 proxy
+CH_RAFT_PEERS=localhost:8020,localhost:8022 go run main.go 8021 proxy
+CH_RAFT_PEERS=localhost:8020,localhost:8021 go run main.go 8022 proxy
+
+DISCOVER NODE SERVERS THROUGH GOSSIP
+CH_GOSSIP=1 has proxies and node servers take part in a gossip cluster, joining it through CH_GOSSIP_SEED when set.
+Proxies add every node server they learn of and remove the ones that die, keys a dead node held are left behind.
+A node removed by hand through /remove-member stays out until it is added back through /add-member.
+CH_GOSSIP_ADDRESS is the address others reach this process at (default localhost:<port>)
+CH_GOSSIP=1 go run main.go 8020 proxy
+CH_GOSSIP=1 CH_GOSSIP_SEED=localhost:8020 go run main.go 8040 node
+CH_GOSSIP=1 CH_GOSSIP_SEED=localhost:8020 go run main.go 8060 node
 */
 func main() {
 	var r *mux.Router
 	if os.Args[2] == "proxy" {
-		hash := func(s string) int {
-			h := fnv.New32a()
-			_, _ = h.Write([]byte(s))
-			return int(h.Sum32())
+		hashName := os.Getenv("CH_HASH")
+		if hashName == "" {
+			hashName = consistenthashing.FNV1a32
+			if os.Getenv("CH_HASH_SPACE") == "64" {
+				hashName = consistenthashing.FNV1a64
+			}
+		}
+		hashKey, err := hex.DecodeString(os.Getenv("CH_HASH_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		hash, err := consistenthashing.HashFunc(hashName, hashKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		partitioner := os.Getenv("CH_PARTITIONER")
+		if partitioner == "" {
+			partitioner = consistenthashing.RingPartitioner
+		}
+		var placement consistenthashing.Partitioner
+		if os.Getenv("CH_HASH_SPACE") == "64" {
+			var hash64 consistenthashing.HashingFunc64
+			hash64, err = consistenthashing.HashFunc64(hashName, hashKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			placement, err = consistenthashing.NewPartitioner64(partitioner, hash64, 8)
+		} else {
+			placement, err = consistenthashing.NewPartitioner(partitioner, hash, 360, 8)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := []consistenthashing.Option{
+			consistenthashing.WithPartitioner(placement),
+			consistenthashing.WithReplicationFactor(envInt("CH_REPLICAS", 1)),
+		}
+		if c, err := strconv.ParseFloat(os.Getenv("CH_CAPACITY_FACTOR"), 64); err == nil {
+			opts = append(opts, consistenthashing.WithBoundedLoad(c))
+		}
+		keysPerSec, _ := strconv.ParseFloat(os.Getenv("CH_MIGRATION_KEYS_PER_SEC"), 64)
+		bytesPerSec, _ := strconv.ParseFloat(os.Getenv("CH_MIGRATION_BYTES_PER_SEC"), 64)
+		opts = append(opts,
+			consistenthashing.WithParallelism(envInt("CH_MIGRATION_PARALLELISM", 16)),
+			consistenthashing.WithThrottle(keysPerSec, bytesPerSec),
+		)
+		if journal := os.Getenv("CH_JOURNAL"); journal != "" {
+			opts = append(opts, consistenthashing.WithJournal(journal))
+		}
+		if state := os.Getenv("CH_STATE"); state != "" {
+			opts = append(opts, consistenthashing.WithStateFile(state))
 		}
 		hmp := consistenthashing.New(
 			"/keys",
@@ -41,10 +128,47 @@ func main() {
 			"/key",
 			hash,
 			360,
+			opts...,
 		)
-		r = proxy.New(hmp)
+		restored, err := hmp.Restore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if restored {
+			log.Printf("Restored ring at epoch %d \n", hmp.Epoch())
+		}
+		recovery, err := hmp.Recover()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if recovery.Interrupted {
+			log.Printf("Recovered interrupted migration of %s, rolled back: %t, now at epoch %d \n", recovery.Member, recovery.RolledBack, recovery.Epoch)
+		}
+		proxyOpts := []proxy.Option{proxy.WithQuorum(envInt("CH_READ_QUORUM", 1), envInt("CH_WRITE_QUORUM", 1))}
+		if peers := os.Getenv("CH_RAFT_PEERS"); peers != "" {
+			address := os.Getenv("CH_RAFT_ADDRESS")
+			if address == "" {
+				address = "localhost:" + os.Args[1]
+			}
+			node, err := raft.New(raft.Config{ID: address, Peers: strings.Split(peers, ","), StatePath: os.Getenv("CH_RAFT_STATE")})
+			if err != nil {
+				log.Fatal(err)
+			}
+			proxyOpts = append(proxyOpts, proxy.WithRaft(node))
+		}
+		if os.Getenv("CH_GOSSIP") != "" {
+			proxyOpts = append(proxyOpts, proxy.WithGossip(newGossipNode(gossip.RoleProxy)))
+		}
+		r, err = proxy.New(hmp, proxyOpts...)
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else if os.Args[2] == "node" {
-		r = servers.GetApp()
+		var nodeOpts []servers.Option
+		if os.Getenv("CH_GOSSIP") != "" {
+			nodeOpts = append(nodeOpts, servers.WithGossip(newGossipNode(gossip.RoleNode)))
+		}
+		r = servers.GetApp(nodeOpts...)
 	} else if os.Args[1] == "test" {
 		masterAddress := os.Args[2]
 		nodes := os.Args[3:]
@@ -57,3 +181,21 @@ func main() {
 		return
 	}
 }
+
+// newGossipNode configures this process' membership of the gossip cluster from the environment
+func newGossipNode(role string) *gossip.Node {
+	address := os.Getenv("CH_GOSSIP_ADDRESS")
+	if address == "" {
+		address = "localhost:" + os.Args[1]
+	}
+	return gossip.New(gossip.Config{Address: address, Role: role, Seed: os.Getenv("CH_GOSSIP_SEED")})
+}
+
+// envInt reads a positive integer setting from the environment, falling back to def when it is unset or invalid
+func envInt(name string, def int) int {
+	val, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || val < 1 {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Option configures the proxy returned by New
+type Option func(*coordinator)
+
+/*
+WithQuorum sets how many replicas have to agree on a read (r) and acknowledge a write or delete (w). Both have to be at
+least 1 and at most the replication factor of the ring, New refuses any other quorum with ErrInvalidQuorum.
+*/
+func WithQuorum(r int, w int) Option {
+	return func(c *coordinator) {
+		c.readQuorum, c.writeQuorum = r, w
+	}
+}
+
+// coordinator fans a key based request out to every replica in the key's preference list and aggregates the answers
+type coordinator struct {
+	readQuorum, writeQuorum int
+	client                  *http.Client
+	// replication is set when the ring is shared with other proxies through raft, discovery when members are learnt
+	// from gossip
+	replication *replication
+	discovery   *discovery
+}
+
+type replicaResponse struct {
+	replica string
+	status  int
+	header  http.Header
+	body    []byte
+	err     error
+}
+
+// quorumError is relayed to the client when not enough replicas agreed or acknowledged a request
+type quorumError struct {
+	Error          string            `json:"error"`
+	Needed         int               `json:"needed"`
+	Agreed         int               `json:"agreed"`
+	FailedReplicas map[string]string `json:"failedReplicas"`
+}
+
+const failedReplicasHeader = "X-Failed-Replicas"
+
+/*
+write forwards a POST or DELETE to every replica and succeeds once writeQuorum of them acknowledge with successStatus.
+The response of an acknowledging replica is relayed, along with the replicas that failed so far. The relayed status code
+is returned.
+*/
+func (c *coordinator) write(w http.ResponseWriter, req *http.Request, shards []string, body []byte, successStatus int) int {
+	responses := c.fanOut(req, shards, body)
+	failed := make(map[string]string)
+	acked := 0
+	for resp := range responses {
+		if resp.err == nil && resp.status == successStatus {
+			acked++
+			if acked == c.writeQuorum {
+				relay(w, resp, failed)
+				return resp.status
+			}
+			continue
+		}
+		failed[resp.replica] = describeFailure(resp)
+	}
+
+	log.Printf("Write quorum not reached, %d of %d acknowledged \n", acked, c.writeQuorum)
+	writeQuorumError(w, "write quorum not reached", c.writeQuorum, acked, failed)
+	return http.StatusServiceUnavailable
+}
+
+/*
+read forwards a GET to every replica in the route and succeeds once readQuorum of them return the same answer.
+Agreeing on a missing key is an answer too, so a 404 from readQuorum replicas is relayed as is, unless the key may not
+have been migrated to its new owners yet: then the previous owners are asked, and their answer is relayed when they
+have the key. The relayed status code is returned.
+*/
+func (c *coordinator) read(w http.ResponseWriter, req *http.Request, route *consistenthashing.Route) int {
+	result := c.collectRead(req, route.Shards, c.readQuorum)
+	if !(result.agreed && result.resp.status == http.StatusOK) && len(route.Fallback) > 0 {
+		log.Printf("Read missed on %v, falling back to previous owners %v \n", route.Shards, route.Fallback)
+		quorum := c.readQuorum
+		if quorum > len(route.Fallback) {
+			quorum = len(route.Fallback)
+		}
+		fallback := c.collectRead(req, route.Fallback, quorum)
+		if fallback.agreed && fallback.resp.status == http.StatusOK {
+			result = fallback
+		}
+	}
+
+	if result.agreed {
+		relay(w, result.resp, result.failed)
+		return result.resp.status
+	}
+
+	log.Printf("Read quorum not reached, %d of %d agreed \n", result.votes, c.readQuorum)
+	writeQuorumError(w, "read quorum not reached", c.readQuorum, result.votes, result.failed)
+	return http.StatusServiceUnavailable
+}
+
+type readResult struct {
+	// agreed is set when quorum replicas returned resp
+	agreed bool
+	resp   replicaResponse
+	// votes is the largest number of replicas that agreed on an answer
+	votes  int
+	failed map[string]string
+}
+
+func (c *coordinator) collectRead(req *http.Request, shards []string, quorum int) readResult {
+	responses := c.fanOut(req, shards, nil)
+	result := readResult{failed: make(map[string]string)}
+	votes := make(map[string]int)
+	for resp := range responses {
+		if resp.err != nil || (resp.status != http.StatusOK && resp.status != http.StatusNotFound) {
+			result.failed[resp.replica] = describeFailure(resp)
+			continue
+		}
+		answer := fmt.Sprintf("%d:%s", resp.status, resp.body)
+		votes[answer]++
+		if votes[answer] > result.votes {
+			result.votes = votes[answer]
+		}
+		if votes[answer] == quorum {
+			result.agreed = true
+			result.resp = resp
+			return result
+		}
+	}
+	return result
+}
+
+// fanOut sends the request to every replica concurrently, the returned channel is closed once all of them answered
+func (c *coordinator) fanOut(req *http.Request, shards []string, body []byte) <-chan replicaResponse {
+	responses := make(chan replicaResponse, len(shards))
+	done := make(chan struct{})
+	for _, shard := range shards {
+		go func(shard string) {
+			responses <- c.send(req, shard, body)
+			done <- struct{}{}
+		}(shard)
+	}
+	go func() {
+		for range shards {
+			<-done
+		}
+		close(responses)
+	}()
+	return responses
+}
+
+func (c *coordinator) send(req *http.Request, shard string, body []byte) replicaResponse {
+	url := fmt.Sprintf("%s://%s%s", "http", shard, req.RequestURI)
+	log.Println("Proxying to ", url)
+
+	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return replicaResponse{replica: shard, err: err}
+	}
+
+	resp, err := c.client.Do(proxyReq)
+	if err != nil {
+		return replicaResponse{replica: shard, err: err}
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return replicaResponse{replica: shard, err: err}
+	}
+	return replicaResponse{replica: shard, status: resp.StatusCode, header: resp.Header, body: buf}
+}
+
+func relay(w http.ResponseWriter, resp replicaResponse, failed map[string]string) {
+	copyHeader(w.Header(), resp.header)
+	if len(failed) > 0 {
+		w.Header().Set(failedReplicasHeader, strings.Join(sortedReplicas(failed), ","))
+	}
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+}
+
+func writeQuorumError(w http.ResponseWriter, msg string, needed int, agreed int, failed map[string]string) {
+	if len(failed) > 0 {
+		w.Header().Set(failedReplicasHeader, strings.Join(sortedReplicas(failed), ","))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(quorumError{Error: msg, Needed: needed, Agreed: agreed, FailedReplicas: failed})
+}
+
+func describeFailure(resp replicaResponse) string {
+	if resp.err != nil {
+		return resp.err.Error()
+	}
+	return fmt.Sprintf("unexpected status %d", resp.status)
+}
+
+func sortedReplicas(failed map[string]string) []string {
+	replicas := make([]string, 0, len(failed))
+	for replica := range failed {
+		replicas = append(replicas, replica)
+	}
+	sort.Strings(replicas)
+	return replicas
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newReplica(t *testing.T, status int, body string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestCoordinator_WriteQuorum(t *testing.T) {
+	ok1 := newReplica(t, http.StatusCreated, "")
+	ok2 := newReplica(t, http.StatusCreated, "")
+	bad := newReplica(t, http.StatusInternalServerError, "")
+
+	coord := &coordinator{readQuorum: 2, writeQuorum: 2, client: &http.Client{}}
+
+	rec := httptest.NewRecorder()
+	coord.write(rec, httptest.NewRequest(http.MethodPost, "/key", nil), []string{ok1, bad, ok2}, []byte(`{}`), http.StatusCreated)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected write quorum to be reached, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	coord.write(rec, httptest.NewRequest(http.MethodPost, "/key", nil), []string{ok1, bad}, []byte(`{}`), http.StatusCreated)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(failedReplicasHeader) != bad {
+		t.Errorf("expected quorum error naming %s, got %d %q", bad, rec.Code, rec.Header().Get(failedReplicasHeader))
+	}
+}
+
+func TestCoordinator_ReadQuorum(t *testing.T) {
+	fresh1 := newReplica(t, http.StatusOK, `{"key":"k","value":"new"}`)
+	fresh2 := newReplica(t, http.StatusOK, `{"key":"k","value":"new"}`)
+	stale := newReplica(t, http.StatusOK, `{"key":"k","value":"old"}`)
+	missing := newReplica(t, http.StatusNotFound, "")
+
+	coord := &coordinator{readQuorum: 2, writeQuorum: 2, client: &http.Client{}}
+
+	rec := httptest.NewRecorder()
+	coord.read(rec, httptest.NewRequest(http.MethodGet, "/key?key=k", nil), &consistenthashing.Route{Shards: []string{stale, fresh1, fresh2}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "new") {
+		t.Errorf("expected agreeing replicas to win, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	coord.read(rec, httptest.NewRequest(http.MethodGet, "/key?key=k", nil), &consistenthashing.Route{Shards: []string{stale, fresh1, missing}})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected disagreeing replicas to fail the read, got %d", rec.Code)
+	}
+}
+
+func TestCoordinator_ReadFallsBackDuringMigration(t *testing.T) {
+	moved := newReplica(t, http.StatusNotFound, "")
+	previous := newReplica(t, http.StatusOK, `{"key":"k","value":"v"}`)
+
+	coord := &coordinator{readQuorum: 1, writeQuorum: 1, client: &http.Client{}}
+
+	rec := httptest.NewRecorder()
+	route := &consistenthashing.Route{Shards: []string{moved}, Fallback: []string{previous}}
+	if status := coord.read(rec, httptest.NewRequest(http.MethodGet, "/key?key=k", nil), route); status != http.StatusOK {
+		t.Errorf("expected the previous owner to answer a miss on the new one, got %d", status)
+	}
+
+	rec = httptest.NewRecorder()
+	route = &consistenthashing.Route{Shards: []string{moved}}
+	if status := coord.read(rec, httptest.NewRequest(http.MethodGet, "/key?key=k", nil), route); status != http.StatusNotFound {
+		t.Errorf("expected a miss without a migration in flight, got %d", status)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"github.com/hamdaankhalid/consistenthashing/gossip"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// reconcileInterval is how often the ring is checked against gossip even when nothing changed, which catches up with
+// changes that failed and with a proxy that only just became leader
+const reconcileInterval = 5 * time.Second
+
+/*
+WithGossip has the proxy take part in node's gossip cluster, node has to be built but not started yet. Node servers
+gossip reports alive or suspected are added to the ring, and members gossip reports dead are removed from it, so
+operators no longer call /add-member for every node. A dead member cannot hand its keys over, so it is removed with
+ContinueOnFailure whatever the configured failure policy is, leaving its keys behind. Members added by hand that gossip
+does not know of are left alone, and so are members removed by hand while gossip had them up, until they are added
+back by hand. With WithRaft only the leader acts on what gossip reports.
+*/
+func WithGossip(node *gossip.Node) Option {
+	return func(c *coordinator) {
+		c.discovery = &discovery{
+			node:    node,
+			changed: make(chan struct{}, 1),
+			removed: make(map[string]bool),
+			dropped: make(map[string]bool),
+			retryAt: make(map[string]time.Time),
+		}
+	}
+}
+
+/*
+discovery keeps the ring in line with the node servers gossip knows of. Everything but node is only touched by the
+goroutine start runs.
+*/
+type discovery struct {
+	node *gossip.Node
+	hmp  *consistenthashing.ConsistentHashing
+	rep  *replication
+	// changed wakes reconcile up whenever gossip reports a change
+	changed chan struct{}
+	// inRing is the ring reconcile last saw, removed the members that left it by hand, dropped the ones it removed
+	inRing  map[string]bool
+	removed map[string]bool
+	dropped map[string]bool
+	// retryAt holds back changes that failed until the next reconcile interval
+	retryAt map[string]time.Time
+}
+
+// start serves the gossip protocol on r and reconciles the ring until node is stopped
+func (d *discovery) start(r *mux.Router, hmp *consistenthashing.ConsistentHashing, rep *replication) {
+	d.hmp, d.rep = hmp, rep
+	d.node.Register(r)
+	d.node.Start(func(member gossip.Member) {
+		select {
+		case d.changed <- struct{}{}:
+		default:
+		}
+	})
+
+	go func() {
+		ticker := time.NewTicker(reconcileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.node.Done():
+				return
+			case <-d.changed:
+			case <-ticker.C:
+			}
+			d.reconcile()
+		}
+	}()
+}
+
+/*
+reconcile adds the node servers gossip knows are up that the ring lacks, and removes the members gossip knows died.
+Every proxy keeps track of members removed by hand, as the ring it adopts through raft tells, so that whichever one
+leads next leaves them alone as well.
+*/
+func (d *discovery) reconcile() {
+	inRing := make(map[string]bool)
+	for _, member := range d.hmp.Snapshot().Members {
+		inRing[member.Address] = true
+	}
+	states := make(map[string]gossip.State)
+	for _, member := range d.node.Members() {
+		if member.Role == gossip.RoleNode {
+			states[member.Address] = member.State
+		}
+	}
+	for address := range d.inRing {
+		if inRing[address] {
+			continue
+		}
+		if state, ok := states[address]; ok && state != gossip.Dead && !d.dropped[address] {
+			log.Printf("%s was removed while gossip reports it %s, leaving it out \n", address, state)
+			d.removed[address] = true
+		}
+		delete(d.dropped, address)
+	}
+	for address := range inRing {
+		delete(d.removed, address)
+	}
+	d.inRing = inRing
+
+	if d.rep != nil && !d.rep.node.IsLeader() {
+		return
+	}
+	for address, state := range states {
+		if d.removed[address] || time.Now().Before(d.retryAt[address]) {
+			continue
+		}
+		var change func() error
+		var announced *announcement
+		if state != gossip.Dead && !inRing[address] {
+			log.Printf("Gossip reports %s %s, adding it \n", address, state)
+			change = func() error {
+				return d.hmp.AddMember(address)
+			}
+			announced = &announcement{Method: http.MethodGet, URI: "/add-member?srv=" + url.QueryEscape(address)}
+		} else if state == gossip.Dead && inRing[address] {
+			log.Printf("Gossip reports %s dead, removing it \n", address)
+			d.dropped[address] = true
+			change = func() error {
+				return d.hmp.RemoveMemberWithPolicy(address, consistenthashing.ContinueOnFailure)
+			}
+			announced = &announcement{Method: http.MethodGet, URI: "/remove-member?force=true&srv=" + url.QueryEscape(address)}
+		} else {
+			continue
+		}
+
+		var err error
+		if d.rep != nil {
+			replicateErr := d.rep.replicate(announced, func() {
+				err = change()
+			})
+			if replicateErr != nil {
+				err = replicateErr
+			}
+		} else {
+			err = change()
+		}
+		if err != nil {
+			log.Printf("Could not change membership of %s: %v \n", address, err)
+			d.retryAt[address] = time.Now().Add(reconcileInterval)
+			continue
+		}
+		delete(d.retryAt, address)
+		// a member added here and removed by hand before the next pass has to count as removed by hand
+		if state != gossip.Dead {
+			inRing[address] = true
+		}
+	}
+}
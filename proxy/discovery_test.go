@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"github.com/hamdaankhalid/consistenthashing/gossip"
+	"github.com/hamdaankhalid/consistenthashing/servers"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newGossipServer serves handler built around a gossip node that others reach at the server's address
+func newGossipServer(t *testing.T, role string, seed string, handler func(node *gossip.Node) http.Handler) (*gossip.Node, *httptest.Server) {
+	var h http.Handler
+	// handler may start node, which others can reach before h is set
+	ready := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-ready
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	node := gossip.New(gossip.Config{
+		Address:          strings.TrimPrefix(srv.URL, "http://"),
+		Role:             role,
+		Seed:             seed,
+		ProtocolPeriod:   30 * time.Millisecond,
+		PingTimeout:      10 * time.Millisecond,
+		SuspicionTimeout: 150 * time.Millisecond,
+	})
+	t.Cleanup(node.Stop)
+	h = handler(node)
+	close(ready)
+	return node, srv
+}
+
+// waitMembers waits for the ring of hmp to hold exactly want, which is left in the order the caller passed it in
+func waitMembers(t *testing.T, hmp *consistenthashing.ConsistentHashing, want ...string) {
+	want = append([]string(nil), want...)
+	sort.Strings(want)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got []string
+		for _, member := range hmp.Snapshot().Members {
+			got = append(got, member.Address)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the ring to hold %v, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscovery_RingFollowsGossip(t *testing.T) {
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", func(s string) int {
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}, 1000003, consistenthashing.WithTransferer(consistenthashing.NewMemoryTransferer()))
+	_, proxyServer := newGossipServer(t, gossip.RoleProxy, "", func(node *gossip.Node) http.Handler {
+		return newRouter(t, hmp, WithGossip(node))
+	})
+
+	seed := strings.TrimPrefix(proxyServer.URL, "http://")
+	var nodes []*gossip.Node
+	var addresses []string
+	var nodeServers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		node, srv := newGossipServer(t, gossip.RoleNode, seed, func(node *gossip.Node) http.Handler {
+			return servers.GetApp(servers.WithGossip(node))
+		})
+		nodes = append(nodes, node)
+		nodeServers = append(nodeServers, srv)
+		addresses = append(addresses, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	waitMembers(t, hmp, addresses...)
+
+	nodes[0].Stop()
+	nodeServers[0].Close()
+	waitMembers(t, hmp, addresses[1])
+}
+
+func TestDiscovery_KeepsManualRemovals(t *testing.T) {
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", func(s string) int {
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}, 1000003, consistenthashing.WithTransferer(consistenthashing.NewMemoryTransferer()))
+	_, proxyServer := newGossipServer(t, gossip.RoleProxy, "", func(node *gossip.Node) http.Handler {
+		return newRouter(t, hmp, WithGossip(node))
+	})
+
+	seed := strings.TrimPrefix(proxyServer.URL, "http://")
+	var addresses []string
+	addNode := func() {
+		_, srv := newGossipServer(t, gossip.RoleNode, seed, func(node *gossip.Node) http.Handler {
+			return servers.GetApp(servers.WithGossip(node))
+		})
+		addresses = append(addresses, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	get := func(uri string) {
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %s to succeed, got status %d", uri, resp.StatusCode)
+		}
+	}
+	addNode()
+	addNode()
+	waitMembers(t, hmp, addresses...)
+
+	get("/remove-member?srv=" + addresses[0])
+	waitMembers(t, hmp, addresses[1])
+
+	// a node joining has the proxy reconcile again, which must leave the removed node out while adding the new one
+	addNode()
+	waitMembers(t, hmp, addresses[1], addresses[2])
+	time.Sleep(200 * time.Millisecond)
+	waitMembers(t, hmp, addresses[1], addresses[2])
+
+	get("/add-member?srv=" + addresses[0])
+	waitMembers(t, hmp, addresses...)
+}
@@ -1,21 +1,56 @@
 package proxy
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
-func New(hmp *consistenthashing.ConsistentHashing) *mux.Router {
+// EpochHeader carries the ring epoch a response was produced under, for key requests the epoch the key was routed with
+const EpochHeader = "X-Ring-Epoch"
+
+// ErrInvalidQuorum is returned by New for a read or write quorum no replica set of the ring can reach
+var ErrInvalidQuorum = errors.New("read and write quorums have to be between 1 and the replication factor")
+
+// ErrBoundedLoadReplication is returned by New for a ring in bounded load mode shared through raft
+var ErrBoundedLoadReplication = errors.New("bounded load assignments cannot be replicated through raft")
+
+// New serves the cluster hmp routes keys for, refusing options that could never serve a request
+func New(hmp *consistenthashing.ConsistentHashing, opts ...Option) (*mux.Router, error) {
+	coord := &coordinator{readQuorum: 1, writeQuorum: 1, client: &http.Client{}}
+	for _, opt := range opts {
+		opt(coord)
+	}
+	n := hmp.ReplicationFactor()
+	if coord.readQuorum < 1 || coord.readQuorum > n || coord.writeQuorum < 1 || coord.writeQuorum > n {
+		return nil, ErrInvalidQuorum
+	}
+	if coord.replication != nil && hmp.CapacityFactor() > 0 {
+		return nil, ErrBoundedLoadReplication
+	}
+
 	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			next.ServeHTTP(&epochWriter{ResponseWriter: writer, hmp: hmp}, request)
+		})
+	})
+
+	rep := coord.replication
+	if rep != nil {
+		rep.start(r, hmp)
+	}
+	if coord.discovery != nil {
+		coord.discovery.start(r, hmp, rep)
+	}
 
 	// UPLOAD KEY VAL
-	r.HandleFunc("/key", func(writer http.ResponseWriter, request *http.Request) {
+	r.HandleFunc("/key", rep.followLeader(func(writer http.ResponseWriter, request *http.Request) {
 		log.Println("Upload Key Request")
 
 		buf, err := io.ReadAll(request.Body)
@@ -24,113 +59,271 @@ func New(hmp *consistenthashing.ConsistentHashing) *mux.Router {
 			return
 		}
 
-		reqCopy := io.NopCloser(bytes.NewBuffer(buf))
-		request.Body = reqCopy
-
 		data := make(map[string]string)
 
 		_ = json.Unmarshal(buf, &data)
 
-		shard, err := hmp.GetShard(data["Key"])
+		route, done, err := hmp.BeginWrite(data["Key"])
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer done()
+		writer.Header().Set(EpochHeader, strconv.FormatUint(route.Epoch, 10))
 
 		log.Printf("Upload for key %s \n", data["Key"])
 
-		// Proxy
-		url := fmt.Sprintf("%s://%s%s", "http", shard, request.RequestURI)
-		proxyRequest(writer, request, url)
-	}).Methods(http.MethodPost)
+		// Proxy to every replica
+		coord.write(writer, request, route.Shards, buf, http.StatusCreated)
+	})).Methods(http.MethodPost)
 
 	// GET BY KEY
-	r.HandleFunc("/key", func(writer http.ResponseWriter, request *http.Request) {
+	r.HandleFunc("/key", rep.followLeader(func(writer http.ResponseWriter, request *http.Request) {
 		log.Println("Get Key Request")
-		relayForKeyBasedRequest(writer, request, hmp)
-	}).Methods(http.MethodGet)
+		key, ok := keyParam(writer, request)
+		if !ok {
+			return
+		}
+		route, err := hmp.Route(key)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set(EpochHeader, strconv.FormatUint(route.Epoch, 10))
+		// a key that turned out not to exist should not count towards a member's load
+		if coord.read(writer, request, route) == http.StatusNotFound {
+			hmp.Release(key)
+		}
+	})).Methods(http.MethodGet)
 
 	// DELETE BY KEY
-	r.HandleFunc("/key", func(writer http.ResponseWriter, request *http.Request) {
+	r.HandleFunc("/key", rep.followLeader(func(writer http.ResponseWriter, request *http.Request) {
 		log.Println("Delete Key Request")
-		relayForKeyBasedRequest(writer, request, hmp)
-	}).Methods(http.MethodDelete)
+		key, ok := keyParam(writer, request)
+		if !ok {
+			return
+		}
+		route, done, err := hmp.BeginWrite(key)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer done()
+		writer.Header().Set(EpochHeader, strconv.FormatUint(route.Epoch, 10))
+		if coord.write(writer, request, route.Shards, nil, http.StatusOK) == http.StatusOK {
+			hmp.Release(key)
+		}
+	})).Methods(http.MethodDelete)
 
-	// Cluster Management APIs are all get requests, that let you interact with and mutate cluster membership changes
+	// Cluster Management APIs are all get requests, that let you interact with and mutate cluster membership changes.
+	// Passing the epoch the caller last saw makes a change compare-and-set, answering 409 when the ring moved on since.
 
 	// Add cluster member
-	r.HandleFunc("/add-member", func(writer http.ResponseWriter, request *http.Request) {
+	r.HandleFunc("/add-member", rep.leaderOnly(func(writer http.ResponseWriter, request *http.Request) {
 		log.Println("Add member Request")
 
+		weight, err := weightParam(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		epoch, compare, err := epochParam(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
 		servers := request.URL.Query()["srv"]
 		for _, server := range servers {
-			err := hmp.AddMember(server)
+			if compare {
+				epoch, err = hmp.CompareAndAddMember(epoch, server, weight)
+			} else {
+				err = hmp.AddMemberWithWeight(server, weight)
+			}
 			if err != nil {
-				writer.WriteHeader(http.StatusInternalServerError)
+				http.Error(writer, err.Error(), membershipStatus(err))
 				return
 			}
 		}
 
 		hmp.PrintTopology()
 		writer.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodGet)
+	})).Methods(http.MethodGet)
 
-	// Remove cluster member
-	r.HandleFunc("/remove-member", func(writer http.ResponseWriter, request *http.Request) {
+	// Remove cluster member, with force=true leaving keys that cannot be moved behind whatever the failure policy is
+	r.HandleFunc("/remove-member", rep.leaderOnly(func(writer http.ResponseWriter, request *http.Request) {
 		log.Println("Remove member Request")
 
+		epoch, compare, err := epochParam(request)
+		force := request.URL.Query().Get("force") == "true"
+		if err != nil || (compare && force) {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
 		servers := request.URL.Query()["srv"]
 
 		for _, server := range servers {
-			err := hmp.RemoveMember(server)
+			if compare {
+				epoch, err = hmp.CompareAndRemoveMember(epoch, server)
+			} else if force {
+				err = hmp.RemoveMemberWithPolicy(server, consistenthashing.ContinueOnFailure)
+			} else {
+				err = hmp.RemoveMember(server)
+			}
 			if err != nil {
-				log.Println("Failed to remove member")
+				log.Println("Failed to remove member", err)
+				http.Error(writer, err.Error(), membershipStatus(err))
+				return
 			}
 		}
 
 		hmp.PrintTopology()
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodGet)
+
+	// Change the weight of a cluster member
+	r.HandleFunc("/set-weight", rep.leaderOnly(func(writer http.ResponseWriter, request *http.Request) {
+		log.Println("Set weight Request")
+
+		weight, err := weightParam(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		epoch, compare, err := epochParam(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
+		servers := request.URL.Query()["srv"]
+		for _, server := range servers {
+			if compare {
+				epoch, err = hmp.CompareAndSetWeight(epoch, server, weight)
+			} else {
+				err = hmp.SetWeight(server, weight)
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), membershipStatus(err))
+				return
+			}
+		}
+
+		hmp.PrintTopology()
 		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodGet)
+
+	// Dry run of adding the add and removing the remove servers, reporting the ranges, keys and bytes that would move
+	r.HandleFunc("/plan", func(writer http.ResponseWriter, request *http.Request) {
+		log.Println("Plan Request")
+
+		plan, err := hmp.Plan(request.URL.Query()["add"], request.URL.Query()["remove"])
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(plan)
 	}).Methods(http.MethodGet)
 
-	return r
-}
+	// Members, ring positions and owned ranges for dashboards and scripts
+	r.HandleFunc("/topology", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(hmp.Topology())
+	}).Methods(http.MethodGet)
+
+	// Export the ring as a snapshot other proxies and clients can load, JSON by default or binary with format=binary
+	r.HandleFunc("/snapshot", func(writer http.ResponseWriter, request *http.Request) {
+		snapshot := hmp.Snapshot()
+		if request.URL.Query().Get("format") != "binary" {
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(snapshot)
+			return
+		}
+		buf, err := snapshot.MarshalBinary()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = writer.Write(buf)
+	}).Methods(http.MethodGet)
 
-func relayForKeyBasedRequest(writer http.ResponseWriter, request *http.Request, hmp *consistenthashing.ConsistentHashing) {
-	key := request.URL.Query()["key"][0]
+	// Import a snapshot exported by a proxy configured the same way, binary when sent as application/octet-stream.
+	// No keys move, this only brings the ring in line with the proxy the snapshot came from.
+	r.HandleFunc("/snapshot", rep.leaderOnly(func(writer http.ResponseWriter, request *http.Request) {
+		log.Println("Import snapshot Request")
 
-	shard, err := hmp.GetShard(key)
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+		var snapshot consistenthashing.Snapshot
+		var err error
+		if request.Header.Get("Content-Type") == "application/octet-stream" {
+			var buf []byte
+			buf, err = io.ReadAll(request.Body)
+			if err == nil {
+				err = snapshot.UnmarshalBinary(buf)
+			}
+		} else {
+			err = json.NewDecoder(request.Body).Decode(&snapshot)
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Proxy
-	url := fmt.Sprintf("%s://%s%s", "http", shard, request.RequestURI)
-	proxyRequest(writer, request, url)
+		if err := hmp.Import(&snapshot); err != nil {
+			status := membershipStatus(err)
+			if errors.Is(err, consistenthashing.ErrInvalidSnapshot) || err == consistenthashing.ErrConfigMismatch {
+				status = http.StatusBadRequest
+			}
+			http.Error(writer, err.Error(), status)
+			return
+		}
+
+		hmp.PrintTopology()
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodPost)
+
+	return r, nil
 }
 
-func proxyRequest(w http.ResponseWriter, req *http.Request, newUrl string) {
-	log.Println("Proxying to ", newUrl)
+// weightParam reads the optional weight query parameter shared by every server in a membership request, defaulting to 1
+func weightParam(request *http.Request) (int, error) {
+	weight := request.URL.Query().Get("weight")
+	if weight == "" {
+		return 1, nil
+	}
+	return strconv.Atoi(weight)
+}
 
-	proxyReq, err := http.NewRequest(req.Method, newUrl, req.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// epochParam reads the optional epoch query parameter, reporting whether the caller asked for a compare-and-set change
+func epochParam(request *http.Request) (uint64, bool, error) {
+	epoch := request.URL.Query().Get("epoch")
+	if epoch == "" {
+		return 0, false, nil
 	}
-	proxyReq.Header = req.Header
-	proxyReq.Header = make(http.Header)
+	parsed, err := strconv.ParseUint(epoch, 10, 64)
+	return parsed, true, err
+}
 
-	resp, err := http.DefaultClient.Do(proxyReq)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+// membershipStatus answers a failed membership change, with a conflict when it was made against a stale epoch
+func membershipStatus(err error) int {
+	if err == consistenthashing.ErrStaleEpoch {
+		return http.StatusConflict
 	}
+	return http.StatusInternalServerError
+}
 
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
-	_ = resp.Body.Close()
+// keyParam reads the key query parameter of a key based request, answering 400 when it is missing
+func keyParam(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	keys := request.URL.Query()["key"]
+	if len(keys) == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	return keys[0], true
 }
 
 func copyHeader(dst, src http.Header) {
@@ -140,3 +333,25 @@ func copyHeader(dst, src http.Header) {
 		}
 	}
 }
+
+// epochWriter stamps a response with the epoch the ring is at when it is written, unless the handler already set one
+type epochWriter struct {
+	http.ResponseWriter
+	hmp *consistenthashing.ConsistentHashing
+}
+
+func (w *epochWriter) stamp() {
+	if w.Header().Get(EpochHeader) == "" {
+		w.Header().Set(EpochHeader, strconv.FormatUint(w.hmp.Epoch(), 10))
+	}
+}
+
+func (w *epochWriter) WriteHeader(status int) {
+	w.stamp()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *epochWriter) Write(b []byte) (int, error) {
+	w.stamp()
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRouter builds a proxy that has to accept its options
+func newRouter(t *testing.T, hmp *consistenthashing.ConsistentHashing, opts ...Option) *mux.Router {
+	r, err := New(hmp, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// newEmptyNode serves a node holding no keys, enough for membership changes to redistribute against
+func newEmptyNode(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestProxy_EpochCompareAndSet(t *testing.T) {
+	hash := func(s string) int {
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", hash, 1000003)
+	r := newRouter(t, hmp)
+	a, b := newEmptyNode(t), newEmptyNode(t)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/add-member?srv="+a+"&epoch=0", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get(EpochHeader) != "1" {
+		t.Errorf("expected the change to be accepted at epoch 1, got %d %q", rec.Code, rec.Header().Get(EpochHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/add-member?srv="+b+"&epoch=0", nil))
+	if rec.Code != http.StatusConflict || rec.Header().Get(EpochHeader) != "1" {
+		t.Errorf("expected a change against a stale epoch to conflict, got %d %q", rec.Code, rec.Header().Get(EpochHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topology", nil))
+	if rec.Header().Get(EpochHeader) != "1" || !strings.Contains(rec.Body.String(), `"epoch":1`) {
+		t.Errorf("expected the topology to report epoch 1, got %q %s", rec.Header().Get(EpochHeader), rec.Body.String())
+	}
+
+	// proxied key requests carry the epoch they were routed with
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/key?key=k", nil))
+	if rec.Header().Get(EpochHeader) != "1" {
+		t.Errorf("expected the proxied response to carry epoch 1, got %q", rec.Header().Get(EpochHeader))
+	}
+}
+
+func TestProxy_RefusesUnreachableQuorums(t *testing.T) {
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", func(s string) int {
+		return len(s)
+	}, 1000003, consistenthashing.WithReplicationFactor(3))
+	for _, quorum := range [][2]int{{0, 1}, {1, 0}, {4, 2}, {2, 4}} {
+		if _, err := New(hmp, WithQuorum(quorum[0], quorum[1])); !errors.Is(err, ErrInvalidQuorum) {
+			t.Errorf("expected R=%d W=%d to be refused with N=3, got %v", quorum[0], quorum[1], err)
+		}
+	}
+	if _, err := New(hmp, WithQuorum(2, 3)); err != nil {
+		t.Errorf("expected R=2 W=3 to be accepted with N=3, got %v", err)
+	}
+}
+
+func TestProxy_FailedRemovalIsReported(t *testing.T) {
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", func(s string) int {
+		return len(s)
+	}, 1000003, consistenthashing.WithRetries(1, time.Millisecond))
+	r := newRouter(t, hmp)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	for _, member := range []string{newEmptyNode(t), strings.TrimPrefix(broken.URL, "http://")} {
+		if err := hmp.AddMember(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/remove-member?srv="+strings.TrimPrefix(broken.URL, "http://"), nil))
+	if rec.Code != http.StatusInternalServerError || len(hmp.Topology().Members) != 2 {
+		t.Errorf("expected the rolled back removal to fail, got %d with %d members", rec.Code, len(hmp.Topology().Members))
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/remove-member?srv=node-z:1&epoch=0", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected a removal against a stale epoch to conflict, got %d", rec.Code)
+	}
+}
+
+func TestProxy_SnapshotExportImport(t *testing.T) {
+	hash := func(s string) int {
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}
+	source := newRouter(t, consistenthashing.New("/keys", "/key", "/key", "/key", hash, 1000003))
+	target := consistenthashing.New("/keys", "/key", "/key", "/key", hash, 1000003)
+	rec := httptest.NewRecorder()
+	source.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/add-member?srv="+newEmptyNode(t)+"&srv="+newEmptyNode(t), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("could not add members, got %d", rec.Code)
+	}
+
+	for _, format := range []string{"json", "binary"} {
+		rec = httptest.NewRecorder()
+		source.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshot?format="+format, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("could not export a %s snapshot, got %d", format, rec.Code)
+		}
+		request := httptest.NewRequest(http.MethodPost, "/snapshot", rec.Body)
+		request.Header.Set("Content-Type", rec.Header().Get("Content-Type"))
+		rec = httptest.NewRecorder()
+		newRouter(t, target).ServeHTTP(rec, request)
+		if rec.Code != http.StatusOK || rec.Header().Get(EpochHeader) != "2" {
+			t.Errorf("expected the %s snapshot to be imported at epoch 2, got %d %q", format, rec.Code, rec.Header().Get(EpochHeader))
+		}
+	}
+	if len(target.Topology().Members) != 2 {
+		t.Errorf("expected the imported ring to hold both members, got %+v", target.Topology().Members)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter(t, target).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/snapshot", strings.NewReader(`{"version":1,"partitioner":"ring"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid snapshot to be rejected, got %d", rec.Code)
+	}
+}
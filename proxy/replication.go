@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"github.com/hamdaankhalid/consistenthashing/raft"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardedHeader marks a request a follower forwarded to the leader, so that it is never forwarded again
+const forwardedHeader = "X-Forwarded-By-Proxy"
+
+// proposeTimeout bounds how long the leader waits for a ring change to be replicated to a majority of proxies
+const proposeTimeout = 10 * time.Second
+
+/*
+WithRaft shares the ring with every other proxy in node's raft group, node has to be built but not started yet. Any
+proxy routes keys, but only the leader changes membership and moves keys: followers forward membership requests to it,
+and adopt the ring it settles on through the raft log. While the leader moves keys followers forward key requests to
+it as well, as only the leader knows which keys were already moved, and so do followers that lost touch with it. A
+change whose leader died before the ring it settled on was replicated is replayed by the next leader. Only the
+membership is replicated, so New refuses a ring built with consistenthashing.WithBoundedLoad: every proxy would assign
+keys that spill over in its own lookup order.
+*/
+func WithRaft(node *raft.Node) Option {
+	return func(c *coordinator) {
+		c.replication = &replication{node: node, client: &http.Client{}}
+	}
+}
+
+// ringCommand is what the leader proposes to the raft log around every membership change
+type ringCommand struct {
+	// Migrating is set while the leader moves keys
+	Migrating bool `json:"migrating"`
+	// Change is the request the command announcing a change is about to run
+	Change *announcement `json:"change,omitempty"`
+	// Snapshot is the ring the change settled on, nil for the command announcing it
+	Snapshot *consistenthashing.Snapshot `json:"snapshot,omitempty"`
+}
+
+// announcement is the request behind a membership change, which a new leader replays when its predecessor did not live
+// to replicate the ring the change settled on
+type announcement struct {
+	Method      string `json:"method"`
+	URI         string `json:"uri"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// replication keeps the ring of a proxy in line with the leader of its raft group
+type replication struct {
+	node   *raft.Node
+	hmp    *consistenthashing.ConsistentHashing
+	router *mux.Router
+	client *http.Client
+	// migrating is set while the leader moves keys, pending is the change it announced
+	migrating atomic.Bool
+	pending   atomic.Pointer[announcement]
+	// mu serialises membership changes on the leader, so that each one is announced and settled before the next
+	mu sync.Mutex
+}
+
+// start serves the raft RPCs on r and joins the group
+func (rep *replication) start(r *mux.Router, hmp *consistenthashing.ConsistentHashing) {
+	rep.hmp, rep.router = hmp, r
+	rep.node.Register(r)
+	rep.node.Start(rep.apply, rep.settle)
+}
+
+// apply adopts a ring the leader settled on, unless this proxy already has it
+func (rep *replication) apply(command []byte) {
+	var cmd ringCommand
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		log.Printf("Could not decode ring command: %v \n", err)
+		return
+	}
+	if cmd.Snapshot != nil && !reflect.DeepEqual(rep.hmp.Snapshot(), cmd.Snapshot) {
+		if err := rep.hmp.Import(cmd.Snapshot); err != nil {
+			log.Printf("Could not adopt the ring at epoch %d: %v \n", cmd.Snapshot.Epoch, err)
+		}
+	}
+	rep.migrating.Store(cmd.Migrating)
+	rep.pending.Store(cmd.Change)
+}
+
+/*
+settle finishes a membership change a previous leader announced without living to replicate the ring it settled on,
+once this proxy leads. That leader may have moved keys already, so the change is replayed rather than dropped: keys it
+moved are not found on their old owners again, the rest are moved, and the ring is replicated as usual.
+*/
+func (rep *replication) settle() {
+	// a command of this term is only applied once every command of the previous leaders is
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	if err := rep.node.Propose(ctx, nil); err != nil {
+		log.Printf("Could not settle the ring as the new leader: %v \n", err)
+		return
+	}
+
+	if change := rep.pending.Load(); change != nil {
+		log.Printf("Replaying %s %s the previous leader did not settle \n", change.Method, change.URI)
+		rep.replay(change)
+		return
+	}
+	if rep.migrating.Load() {
+		rep.mu.Lock()
+		defer rep.mu.Unlock()
+		if err := rep.propose(ringCommand{}); err != nil {
+			log.Printf("Could not settle the ring as the new leader: %v \n", err)
+		}
+	}
+}
+
+// replay runs change through the proxy's own routes, as if it had just been requested
+func (rep *replication) replay(change *announcement) {
+	request, err := http.NewRequest(change.Method, change.URI, bytes.NewReader(change.Body))
+	if err != nil {
+		log.Printf("Could not replay %s %s: %v \n", change.Method, change.URI, err)
+		return
+	}
+	if change.ContentType != "" {
+		request.Header.Set("Content-Type", change.ContentType)
+	}
+	buffered := &bufferedWriter{header: make(http.Header)}
+	rep.router.ServeHTTP(buffered, request)
+	buffered.WriteHeader(http.StatusOK)
+	log.Printf("Replayed %s %s, answered %d \n", change.Method, change.URI, buffered.status)
+}
+
+func (rep *replication) propose(cmd ringCommand) error {
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	return rep.node.Propose(ctx, buf)
+}
+
+/*
+leaderOnly runs a membership change on the leader, forwarding it there from followers. The caller only hears back once
+the ring the change settled on was replicated.
+*/
+func (rep *replication) leaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	if rep == nil {
+		return handler
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !rep.node.IsLeader() {
+			rep.forward(writer, request)
+			return
+		}
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		change := &announcement{
+			Method:      request.Method,
+			URI:         request.URL.RequestURI(),
+			ContentType: request.Header.Get("Content-Type"),
+			Body:        body,
+		}
+
+		buffered := &bufferedWriter{header: make(http.Header)}
+		err = rep.replicate(change, func() {
+			handler(buffered, request)
+		})
+		if errors.Is(err, errNotAnnounced) {
+			rep.forward(writer, request)
+			return
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		buffered.relay(writer)
+	}
+}
+
+// errNotAnnounced is returned by replicate when this proxy lost its leadership before the change could start
+var errNotAnnounced = errors.New("membership change not announced, this proxy is no longer the leader")
+
+/*
+replicate runs change on the leader, announcing to followers that keys are moving before it starts, and replicating the
+ring it settled on once it is done. Keys only start moving once every follower knows, or can no longer know anything
+and forwards to the leader instead. The announcement carries announced, the request that makes the same change, for the
+next leader to replay should this one not live to replicate the ring.
+*/
+func (rep *replication) replicate(announced *announcement, change func()) error {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	if err := rep.propose(ringCommand{Migrating: true, Change: announced}); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return errNotAnnounced
+		}
+		return err
+	}
+	// followers still routing with the current ring would write where keys are about to be moved from
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	if err := rep.node.Barrier(ctx); err != nil {
+		// a leader that is still around withdraws the announcement, otherwise the next leader replays it
+		if rep.node.IsLeader() {
+			if err := rep.propose(ringCommand{}); err != nil {
+				log.Printf("Could not withdraw the announced change: %v \n", err)
+			}
+		}
+		return errors.New("followers did not hear keys are moving: " + err.Error())
+	}
+	change()
+	if err := rep.propose(ringCommand{Snapshot: rep.hmp.Snapshot()}); err != nil {
+		log.Printf("Could not replicate the ring at epoch %d: %v \n", rep.hmp.Epoch(), err)
+		return errors.New("ring changed but not replicated: " + err.Error())
+	}
+	return nil
+}
+
+/*
+followLeader forwards key requests to the leader while it moves keys, followers do not know where they are, and while
+this follower has not heard from the leader lately, as keys may be moving without it knowing.
+*/
+func (rep *replication) followLeader(handler http.HandlerFunc) http.HandlerFunc {
+	if rep == nil {
+		return handler
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !rep.node.IsLeader() && (rep.migrating.Load() || !rep.node.HasLease()) {
+			rep.forward(writer, request)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// forward relays request to the leader and its answer back
+func (rep *replication) forward(writer http.ResponseWriter, request *http.Request) {
+	leader := rep.node.Leader()
+	if leader == "" || leader == rep.node.ID() || request.Header.Get(forwardedHeader) != "" {
+		http.Error(writer, "no raft leader to forward to", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Forwarding %s %s to leader %s \n", request.Method, request.URL.Path, leader)
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	forwarded, err := http.NewRequest(request.Method, "http://"+leader+request.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	copyHeader(forwarded.Header, request.Header)
+	forwarded.Header.Set(forwardedHeader, rep.node.ID())
+
+	resp, err := rep.client.Do(forwarded)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	copyHeader(writer.Header(), resp.Header)
+	writer.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(writer, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// bufferedWriter holds on to a response until relay passes it on
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *bufferedWriter) relay(writer http.ResponseWriter) {
+	copyHeader(writer.Header(), w.header)
+	w.WriteHeader(http.StatusOK)
+	writer.WriteHeader(w.status)
+	_, _ = writer.Write(w.body.Bytes())
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/hamdaankhalid/consistenthashing/consistenthashing"
+	"github.com/hamdaankhalid/consistenthashing/raft"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProxy is one of a group of proxies sharing their ring through raft
+type testProxy struct {
+	hmp    *consistenthashing.ConsistentHashing
+	node   *raft.Node
+	server *httptest.Server
+}
+
+func newProxyGroup(t *testing.T, size int) []*testProxy {
+	hash := func(s string) int {
+		h := 0
+		for _, c := range s {
+			h = h*31 + int(c)
+		}
+		return h
+	}
+	proxies := make([]*testProxy, size)
+	handlers := make([]http.Handler, size)
+	var ids []string
+	for i := range proxies {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		proxies[i] = &testProxy{server: srv}
+		ids = append(ids, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	for i, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		node, err := raft.New(raft.Config{ID: id, Peers: peers, ElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 20 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Stop)
+		proxies[i].node = node
+		proxies[i].hmp = consistenthashing.New("/keys", "/key", "/key", "/key", hash, 1000003,
+			consistenthashing.WithTransferer(consistenthashing.NewMemoryTransferer()))
+		handlers[i] = newRouter(t, proxies[i].hmp, WithRaft(node))
+	}
+	return proxies
+}
+
+// leaderAndFollower waits for one of proxies to lead, and returns it along with another one that knows it does
+func leaderAndFollower(t *testing.T, proxies []*testProxy) (*testProxy, *testProxy) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, p := range proxies {
+			follower := proxies[(i+1)%len(proxies)]
+			if p.node.IsLeader() && follower.node.Leader() == p.node.ID() {
+				return p, follower
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil, nil
+}
+
+// waitSameRing waits for every proxy to route with the same ring at epoch
+func waitSameRing(t *testing.T, proxies []*testProxy, epoch uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		same := true
+		for _, p := range proxies {
+			if p.hmp.Epoch() != epoch || !reflect.DeepEqual(p.hmp.Snapshot(), proxies[0].hmp.Snapshot()) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxies did not agree on the ring at epoch %d", epoch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication_FollowersForwardChangesAndAdoptTheRing(t *testing.T) {
+	proxies := newProxyGroup(t, 3)
+	leader, follower := leaderAndFollower(t, proxies)
+
+	resp, err := http.Get(follower.server.URL + "/add-member?srv=node-a:1&srv=node-b:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(EpochHeader) != "2" {
+		t.Fatalf("expected the forwarded change to land at epoch 2, got %d %q", resp.StatusCode, resp.Header.Get(EpochHeader))
+	}
+	if len(leader.hmp.Topology().Members) != 2 {
+		t.Errorf("expected the leader to have made the change")
+	}
+	waitSameRing(t, proxies, 2)
+
+	// a stale compare-and-set is answered by the leader through the follower
+	resp, err = http.Get(follower.server.URL + "/add-member?srv=node-c:1&epoch=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected a stale change to conflict, got %d", resp.StatusCode)
+	}
+
+	// the survivors elect a new leader that keeps changing the same ring
+	leader.node.Stop()
+	leader.server.Close()
+	var survivors []*testProxy
+	for _, p := range proxies {
+		if p != leader {
+			survivors = append(survivors, p)
+		}
+	}
+	_, follower = leaderAndFollower(t, survivors)
+	resp, err = http.Get(follower.server.URL + "/remove-member?srv=node-a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the change to be accepted by the new leader, got %d", resp.StatusCode)
+	}
+	waitSameRing(t, survivors, 3)
+	for _, p := range survivors {
+		if shard, err := p.hmp.GetShard("some-key"); err != nil || shard != "node-b:1" {
+			t.Errorf("expected every proxy to route to node-b:1, got %s %v", shard, err)
+		}
+	}
+}
+
+func TestReplication_RefusesBoundedLoad(t *testing.T) {
+	node, err := raft.New(raft.Config{ID: "localhost:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmp := consistenthashing.New("/keys", "/key", "/key", "/key", func(s string) int {
+		return len(s)
+	}, 1000003, consistenthashing.WithBoundedLoad(1.25))
+	if _, err := New(hmp, WithRaft(node)); !errors.Is(err, ErrBoundedLoadReplication) {
+		t.Errorf("expected a bounded load ring not to be replicated, got %v", err)
+	}
+}
+
+func TestReplication_NewLeaderReplaysAnUnsettledChange(t *testing.T) {
+	proxies := newProxyGroup(t, 3)
+	leader, _ := leaderAndFollower(t, proxies)
+
+	// the leader dies once it moved keys, before it could replicate the ring they moved for
+	rep := &replication{node: leader.node, hmp: leader.hmp}
+	err := rep.replicate(&announcement{Method: http.MethodGet, URI: "/add-member?srv=node-a:1"}, func() {
+		if err := leader.hmp.AddMember("node-a:1"); err != nil {
+			t.Error(err)
+		}
+		leader.node.Stop()
+		leader.server.Close()
+	})
+	if err == nil {
+		t.Fatal("expected the ring not to be replicated")
+	}
+
+	var survivors []*testProxy
+	for _, p := range proxies {
+		if p != leader {
+			survivors = append(survivors, p)
+		}
+	}
+	waitSameRing(t, survivors, 1)
+	for _, p := range survivors {
+		if shard, err := p.hmp.GetShard("some-key"); err != nil || shard != "node-a:1" {
+			t.Errorf("expected every proxy to route to node-a:1, got %s %v", shard, err)
+		}
+	}
+}
@@ -0,0 +1,739 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/hamdaankhalid/consistenthashing/internal/atomicfile"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Routes the raft RPCs are served on, Register adds them to a router
+const (
+	RequestVoteRoute   = "/raft/request-vote"
+	AppendEntriesRoute = "/raft/append-entries"
+)
+
+// ErrNotLeader is returned by Propose on a node that is not the leader, or that stopped being it before the command
+// was applied. The command may still end up committed by the next leader.
+var ErrNotLeader = errors.New("not the raft leader")
+
+// ErrStopped is returned by Propose once the node was stopped
+var ErrStopped = errors.New("raft node stopped")
+
+type Config struct {
+	// ID is the host:port peers reach this node's routes at, it doubles as its name in the group
+	ID string
+	// Peers lists the IDs of every other node in the group, which never changes
+	Peers []string
+	// ElectionTimeout is how long a follower waits to hear from a leader before it stands for election, randomised
+	// between itself and twice itself. It defaults to 300ms.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader reaches out to followers that are up to date, 50ms by default
+	HeartbeatInterval time.Duration
+	// StatePath keeps the term, vote and log on disk so that a restarted node rejoins where it left off, without it
+	// they are only kept in memory. The log is never compacted and the whole file is rewritten and synced on every
+	// append, while the node is locked, so it only suits a group whose commands are few, as ring changes are.
+	StatePath string
+	// Client sends RPCs to peers, by default one that gives up after the election timeout
+	Client *http.Client
+}
+
+// Entry is a command in the log, along with the term of the leader that appended it
+type Entry struct {
+	Term uint64 `json:"term"`
+	// Command is nil for the entry every new leader appends to commit the entries of its predecessors
+	Command []byte `json:"command,omitempty"`
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+/*
+Node is a member of a raft group (Ongaro and Ousterhout, "In Search of an Understandable Consensus Algorithm"),
+replicating a log of opaque commands over HTTP. It implements leader election and log replication for a group of fixed
+size, without log compaction or membership changes, which is all it takes to agree on rarely changing state. Every node
+applies committed commands in log order, only the leader accepts new ones.
+*/
+type Node struct {
+	config   Config
+	client   *http.Client
+	apply    func(command []byte)
+	onLeader func()
+
+	// mu guards everything below, cond is broadcast whenever the commit index, the applied index, the term, the role
+	// or whether the node is stopped change
+	mu       sync.Mutex
+	cond     *sync.Cond
+	role     role
+	term     uint64
+	votedFor string
+	leaderID string
+	// log starts with a sentinel entry so that entries are indexed from 1, as in the paper
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	// nextIndex and matchIndex track the log of every follower while leading, inflight the followers an append is
+	// on its way to
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+	// applied and acked are what every follower last reported applying and when, for Barrier. leaseStart is when a
+	// follower last accepted entries from its leader, for HasLease.
+	applied    map[string]uint64
+	acked      map[string]time.Time
+	leaseStart time.Time
+	// deadline is when a follower stands for election unless it heard from a leader, lastHeartbeat when a leader last
+	// reached out to its followers
+	deadline      time.Time
+	lastHeartbeat time.Time
+	stopped       bool
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// New builds a follower with the term, vote and log found at config.StatePath, Start sets it off
+func New(config Config) (*Node, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = 300 * time.Millisecond
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 50 * time.Millisecond
+	}
+	n := &Node{
+		config: config,
+		client: config.Client,
+		log:    []Entry{{}},
+		stop:   make(chan struct{}),
+	}
+	if n.client == nil {
+		n.client = &http.Client{Timeout: config.ElectionTimeout}
+	}
+	n.cond = sync.NewCond(&n.mu)
+
+	if config.StatePath != "" {
+		buf, err := os.ReadFile(config.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var state persistentState
+			if err := json.Unmarshal(buf, &state); err != nil {
+				return nil, err
+			}
+			n.term, n.votedFor = state.Term, state.VotedFor
+			n.log = append(n.log, state.Log...)
+		}
+	}
+	return n, nil
+}
+
+// Register serves the RPCs peers send this node on r
+func (n *Node) Register(r *mux.Router) {
+	r.HandleFunc(RequestVoteRoute, n.handleRequestVote).Methods(http.MethodPost)
+	r.HandleFunc(AppendEntriesRoute, n.handleAppendEntries).Methods(http.MethodPost)
+}
+
+/*
+Start sets the node off as a follower. apply is called with every committed command, in log order, from a single
+goroutine, including the commands a restarted node finds in its log again, so it has to be idempotent. onLeader, when
+set, is called from a goroutine of its own every time the node becomes leader.
+*/
+func (n *Node) Start(apply func(command []byte), onLeader func()) {
+	n.mu.Lock()
+	n.apply, n.onLeader = apply, onLeader
+	n.resetDeadlineLocked()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyCommitted()
+}
+
+// Stop stops taking part in the group, as if the node had died, and waits for the node's goroutines to return
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.cond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+// Leader returns the ID of the leader this node last heard from, empty while it does not know of any
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader && !n.stopped
+}
+
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+/*
+Propose appends command to the log and waits until it is committed and applied on this node, or ctx is done. Only the
+leader accepts commands, every other node answers ErrNotLeader right away. A nil command is never applied, proposing
+one just waits for every command before it to be applied.
+*/
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+	if n.role != leader {
+		return ErrNotLeader
+	}
+	n.log = append(n.log, Entry{Term: n.term, Command: command})
+	index, term := n.lastIndexLocked(), n.term
+	n.persistLocked()
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+
+	// wake the wait below up when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.cond.Broadcast()
+			n.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	for n.lastApplied < index {
+		if n.stopped {
+			return ErrStopped
+		}
+		if n.role != leader || n.term != term {
+			return ErrNotLeader
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+	if n.log[index].Term != term {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+/*
+Barrier waits until every follower applied every command the leader applied, or can no longer hold a lease: once the
+leader has not heard back from a follower in twice the election timeout, the follower stopped accepting entries at
+least an election timeout ago, even counting messages that took a while to reach it. Only the leader accepts barriers.
+*/
+func (n *Node) Barrier(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+	if n.role != leader {
+		return ErrNotLeader
+	}
+	index, term := n.lastApplied, n.term
+	n.broadcastLocked()
+
+	// wake the wait below up when ctx is done, and every heartbeat as leases run out without anything to wake it up
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(n.config.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				n.mu.Lock()
+				n.cond.Broadcast()
+				n.mu.Unlock()
+				return
+			case <-ticker.C:
+				n.mu.Lock()
+				n.cond.Broadcast()
+				n.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		if n.stopped {
+			return ErrStopped
+		}
+		if n.role != leader || n.term != term {
+			return ErrNotLeader
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		waiting := false
+		for _, peer := range n.config.Peers {
+			if n.applied[peer] < index && time.Since(n.acked[peer]) < 2*n.config.ElectionTimeout {
+				waiting = true
+			}
+		}
+		if !waiting {
+			return nil
+		}
+		n.cond.Wait()
+	}
+}
+
+/*
+HasLease reports whether a follower is up to date with its leader: it accepted entries from the leader within the
+election timeout and applied every command it knows to be committed. A leader passing a Barrier knows every follower
+holding a lease applied what it did.
+*/
+func (n *Node) HasLease() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == follower && !n.stopped && time.Since(n.leaseStart) < n.config.ElectionTimeout &&
+		n.lastApplied >= n.commitIndex
+}
+
+// run stands for election when no leader was heard from in time, and keeps followers up to date while leading
+func (n *Node) run() {
+	defer n.wg.Done()
+	tick := n.config.HeartbeatInterval / 5
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.role == leader {
+			if time.Since(n.lastHeartbeat) >= n.config.HeartbeatInterval {
+				n.broadcastLocked()
+			}
+		} else if time.Now().After(n.deadline) {
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// applyCommitted hands every committed command to apply, in log order
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for n.lastApplied >= n.commitIndex && !n.stopped {
+			n.cond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		from, to := n.lastApplied+1, n.commitIndex
+		entries := append([]Entry(nil), n.log[from:to+1]...)
+		n.mu.Unlock()
+		for _, entry := range entries {
+			if entry.Command != nil && n.apply != nil {
+				n.apply(entry.Command)
+			}
+		}
+		n.mu.Lock()
+		n.lastApplied = to
+		n.cond.Broadcast()
+	}
+}
+
+func (n *Node) majority() int {
+	return (len(n.config.Peers)+1)/2 + 1
+}
+
+func (n *Node) lastIndexLocked() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) resetDeadlineLocked() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// stepDownLocked turns the node into a follower, of term when it is newer than the one the node is at
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor, n.leaderID = term, "", ""
+		n.persistLocked()
+	}
+	n.role = follower
+	n.resetDeadlineLocked()
+	n.cond.Broadcast()
+}
+
+// startElectionLocked moves on to the next term and asks every peer for its vote
+func (n *Node) startElectionLocked() {
+	n.role = candidate
+	n.term++
+	n.votedFor, n.leaderID = n.config.ID, ""
+	n.persistLocked()
+	n.resetDeadlineLocked()
+	n.cond.Broadcast()
+
+	term := n.term
+	args := requestVoteArgs{
+		Term:         term,
+		Candidate:    n.config.ID,
+		LastLogIndex: n.lastIndexLocked(),
+		LastLogTerm:  n.log[n.lastIndexLocked()].Term,
+	}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeaderLocked()
+		return
+	}
+	log.Printf("Standing for election in term %d \n", term)
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			var reply requestVoteReply
+			if err := n.call(peer, RequestVoteRoute, args, &reply); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.stepDownLocked(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.majority() {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeaderLocked starts leading, committing what previous leaders left behind through an entry of its own term
+func (n *Node) becomeLeaderLocked() {
+	log.Printf("Elected raft leader in term %d \n", n.term)
+	n.role = leader
+	n.leaderID = n.config.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inflight = make(map[string]bool)
+	n.applied = make(map[string]uint64)
+	n.acked = make(map[string]time.Time)
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastIndexLocked() + 1
+		// a follower may still hold a lease from the previous leader
+		n.acked[peer] = time.Now()
+	}
+	n.log = append(n.log, Entry{Term: n.term})
+	n.persistLocked()
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.cond.Broadcast()
+	if n.onLeader != nil {
+		go n.onLeader()
+	}
+}
+
+// broadcastLocked sends every follower the entries it is missing, or a heartbeat when it is up to date
+func (n *Node) broadcastLocked() {
+	n.lastHeartbeat = time.Now()
+	for _, peer := range n.config.Peers {
+		if !n.inflight[peer] {
+			n.inflight[peer] = true
+			go n.sendAppend(peer)
+		}
+	}
+}
+
+// sendAppend sends peer the entries from its next index on, backing up until its log matches the leader's
+func (n *Node) sendAppend(peer string) {
+	n.mu.Lock()
+	if n.role != leader || n.stopped {
+		n.inflight[peer] = false
+		n.mu.Unlock()
+		return
+	}
+	prev := n.nextIndex[peer] - 1
+	args := appendEntriesArgs{
+		Term:         n.term,
+		Leader:       n.config.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log[prev].Term,
+		Entries:      append([]Entry(nil), n.log[prev+1:]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	var reply appendEntriesReply
+	err := n.call(peer, AppendEntriesRoute, args, &reply)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.term {
+		n.stepDownLocked(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != args.Term || n.stopped {
+		return
+	}
+	if reply.Success {
+		if match := prev + uint64(len(args.Entries)); match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		if reply.Applied > n.applied[peer] {
+			n.applied[peer] = reply.Applied
+		}
+		n.acked[peer] = time.Now()
+		n.cond.Broadcast()
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitLocked()
+		if n.nextIndex[peer] <= n.lastIndexLocked() {
+			n.inflight[peer] = true
+			go n.sendAppend(peer)
+		}
+		return
+	}
+	// the follower's log does not match at prev, back up to where it may
+	next := reply.LastIndex + 1
+	if next > prev {
+		next = prev
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+	n.inflight[peer] = true
+	go n.sendAppend(peer)
+}
+
+// advanceCommitLocked commits the latest entry of the current term a majority holds, and every entry before it
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex && n.log[index].Term == n.term; index-- {
+		holders := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				holders++
+			}
+		}
+		if holders >= n.majority() {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+type requestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type requestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type appendEntriesArgs struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+type appendEntriesReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is the last entry the leader can expect to match when Success is not set
+	LastIndex uint64 `json:"lastIndex"`
+	// Applied is the last entry the follower applied
+	Applied uint64 `json:"applied"`
+}
+
+func (n *Node) handleRequestVote(writer http.ResponseWriter, request *http.Request) {
+	var args requestVoteArgs
+	if err := json.NewDecoder(request.Body).Decode(&args); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if args.Term > n.term {
+		n.stepDownLocked(args.Term)
+	}
+	reply := requestVoteReply{Term: n.term}
+	lastIndex := n.lastIndexLocked()
+	lastTerm := n.log[lastIndex].Term
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if args.Term == n.term && (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		n.persistLocked()
+		n.resetDeadlineLocked()
+		reply.VoteGranted = true
+	}
+	n.mu.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(reply)
+}
+
+func (n *Node) handleAppendEntries(writer http.ResponseWriter, request *http.Request) {
+	var args appendEntriesArgs
+	if err := json.NewDecoder(request.Body).Decode(&args); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	reply := n.appendEntriesLocked(args)
+	n.mu.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(reply)
+}
+
+func (n *Node) appendEntriesLocked(args appendEntriesArgs) appendEntriesReply {
+	if args.Term < n.term {
+		return appendEntriesReply{Term: n.term}
+	}
+	if args.Term > n.term || n.role != follower {
+		n.stepDownLocked(args.Term)
+	}
+	n.leaderID = args.Leader
+	n.resetDeadlineLocked()
+
+	reply := appendEntriesReply{Term: n.term}
+	if args.PrevLogIndex > n.lastIndexLocked() {
+		reply.LastIndex = n.lastIndexLocked()
+		return reply
+	}
+	if n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		reply.LastIndex = args.PrevLogIndex - 1
+		return reply
+	}
+
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndexLocked() {
+			if n.log[index].Term == entry.Term {
+				continue
+			}
+			// a conflicting entry was never committed, it goes along with everything after it
+			n.log = n.log[:index]
+		}
+		n.log = append(n.log, args.Entries[i:]...)
+		n.persistLocked()
+		break
+	}
+
+	if lastNew := args.PrevLogIndex + uint64(len(args.Entries)); args.LeaderCommit > n.commitIndex {
+		commit := args.LeaderCommit
+		if lastNew < commit {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.cond.Broadcast()
+		}
+	}
+	reply.Success = true
+	reply.Applied = n.lastApplied
+	n.leaseStart = time.Now()
+	return reply
+}
+
+// call sends an RPC to peer and decodes its reply
+func (n *Node) call(peer string, route string, args interface{}, reply interface{}) error {
+	buf, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post("http://"+peer+route, "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft rpc %s to %s unsuccessful got %d", route, peer, resp.StatusCode)
+	}
+	return err
+}
+
+// persistentState is what a node has to remember across restarts to keep the promises it made
+type persistentState struct {
+	Term     uint64  `json:"term"`
+	VotedFor string  `json:"votedFor"`
+	Log      []Entry `json:"log"`
+}
+
+// persistLocked rewrites the state file, through a temporary file that is synced and renamed over it
+func (n *Node) persistLocked() {
+	if n.config.StatePath == "" {
+		return
+	}
+	buf, err := json.Marshal(persistentState{Term: n.term, VotedFor: n.votedFor, Log: n.log[1:]})
+	if err == nil {
+		err = atomicfile.Write(n.config.StatePath, buf)
+	}
+	if err != nil {
+		log.Printf("Could not persist raft state to %s: %v \n", n.config.StatePath, err)
+	}
+}
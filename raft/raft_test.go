@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGroup is a raft group of nodes served on localhost, recording the commands every node applied
+type testGroup struct {
+	t       *testing.T
+	nodes   []*Node
+	servers []*httptest.Server
+	mu      sync.Mutex
+	applied map[string][]string
+}
+
+func newTestGroup(t *testing.T, size int, dir string) *testGroup {
+	g := &testGroup{t: t, applied: make(map[string][]string)}
+	handlers := make([]http.Handler, size)
+	var ids []string
+	for i := 0; i < size; i++ {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		g.servers = append(g.servers, srv)
+		ids = append(ids, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	for i, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		config := Config{ID: id, Peers: peers, ElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 20 * time.Millisecond}
+		if dir != "" {
+			config.StatePath = filepath.Join(dir, fmt.Sprintf("raft-%d.json", i))
+		}
+		node, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := mux.NewRouter()
+		node.Register(r)
+		handlers[i] = r
+		g.start(node)
+		g.nodes = append(g.nodes, node)
+		t.Cleanup(node.Stop)
+	}
+	return g
+}
+
+func (g *testGroup) start(node *Node) {
+	node.Start(func(command []byte) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.applied[node.ID()] = append(g.applied[node.ID()], string(command))
+	}, nil)
+}
+
+// leader waits for exactly one running node to lead
+func (g *testGroup) leader() *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for _, node := range g.nodes {
+			if node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	g.t.Fatal("no leader elected")
+	return nil
+}
+
+// waitApplied waits for every node in nodes to have applied exactly want
+func (g *testGroup) waitApplied(nodes []*Node, want []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.Lock()
+		done := true
+		for _, node := range nodes {
+			if strings.Join(g.applied[node.ID()], ",") != strings.Join(want, ",") {
+				done = false
+			}
+		}
+		applied := fmt.Sprint(g.applied)
+		g.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			g.t.Fatalf("expected every node to apply %v, got %s", want, applied)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func propose(t *testing.T, node *Node, command string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.Propose(ctx, []byte(command)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaft_ReplicatesCommandsInOrder(t *testing.T) {
+	g := newTestGroup(t, 3, "")
+	leader := g.leader()
+	for _, node := range g.nodes {
+		if node != leader {
+			if err := node.Propose(context.Background(), []byte("x")); err != ErrNotLeader {
+				t.Errorf("expected a follower to refuse commands, got %v", err)
+			}
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		propose(t, leader, fmt.Sprintf("cmd-%d", i))
+	}
+	g.waitApplied(g.nodes, []string{"cmd-0", "cmd-1", "cmd-2", "cmd-3", "cmd-4"})
+	for _, node := range g.nodes {
+		if node.Leader() != leader.ID() {
+			t.Errorf("expected %s to follow %s, got %q", node.ID(), leader.ID(), node.Leader())
+		}
+	}
+}
+
+func TestRaft_ElectsNewLeaderWhenLeaderDies(t *testing.T) {
+	g := newTestGroup(t, 3, "")
+	leader := g.leader()
+	propose(t, leader, "before")
+	g.waitApplied(g.nodes, []string{"before"})
+
+	leader.Stop()
+	var survivors []*Node
+	for _, node := range g.nodes {
+		if node != leader {
+			survivors = append(survivors, node)
+		}
+	}
+	g.nodes = survivors
+	next := g.leader()
+	if next.Term() <= leader.Term() {
+		t.Errorf("expected the new leader to be at a later term than %d, got %d", leader.Term(), next.Term())
+	}
+	propose(t, next, "after")
+	g.waitApplied(survivors, []string{"before", "after"})
+}
+
+func TestRaft_RestartedNodeKeepsItsLog(t *testing.T) {
+	dir := t.TempDir()
+	g := newTestGroup(t, 1, dir)
+	leader := g.leader()
+	propose(t, leader, "kept")
+	leader.Stop()
+
+	restarted, err := New(leader.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Term() != leader.Term() || len(restarted.log) != len(leader.log) {
+		t.Fatalf("expected term %d and %d entries, got %d and %d", leader.Term(), len(leader.log), restarted.Term(), len(restarted.log))
+	}
+	g.applied = make(map[string][]string)
+	g.nodes = []*Node{restarted}
+	g.start(restarted)
+	t.Cleanup(restarted.Stop)
+	propose(t, g.leader(), "new")
+	g.waitApplied(g.nodes, []string{"kept", "new"})
+}
+
+func TestRaft_BarrierWaitsForFollowersToApply(t *testing.T) {
+	g := newTestGroup(t, 3, "")
+	leader := g.leader()
+	var followers []int
+	for i, node := range g.nodes {
+		if node != leader {
+			followers = append(followers, i)
+		}
+	}
+
+	barrier := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := leader.Barrier(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	propose(t, leader, "a")
+	barrier()
+	g.mu.Lock()
+	for _, i := range followers {
+		if strings.Join(g.applied[g.nodes[i].ID()], ",") != "a" {
+			t.Errorf("expected %s to have applied a once the barrier passed, got %v", g.nodes[i].ID(), g.applied[g.nodes[i].ID()])
+		}
+	}
+	g.mu.Unlock()
+	if !g.nodes[followers[0]].HasLease() {
+		t.Errorf("expected a follower that is up to date to hold a lease")
+	}
+
+	// a follower that is gone only holds the barrier up until its lease ran out
+	gone := g.nodes[followers[1]]
+	gone.Stop()
+	g.servers[followers[1]].Close()
+	propose(t, leader, "b")
+	barrier()
+	g.mu.Lock()
+	if applied := strings.Join(g.applied[g.nodes[followers[0]].ID()], ","); applied != "a,b" {
+		t.Errorf("expected the remaining follower to have applied a,b once the barrier passed, got %s", applied)
+	}
+	g.mu.Unlock()
+	if gone.HasLease() {
+		t.Errorf("expected a stopped follower not to hold a lease")
+	}
+}
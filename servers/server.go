@@ -3,6 +3,7 @@ package servers
 import (
 	"encoding/json"
 	"github.com/gorilla/mux"
+	"github.com/hamdaankhalid/consistenthashing/gossip"
 	"log"
 	"net/http"
 	"sync"
@@ -17,7 +18,18 @@ type uploadReq struct {
 	Value string `json:"value"`
 }
 
-func GetApp() *mux.Router {
+// Option adds optional behaviour to the router GetApp builds
+type Option func(r *mux.Router)
+
+// WithGossip serves node's gossip protocol next to the key routes and sets it off, joining the cluster through its seed
+func WithGossip(node *gossip.Node) Option {
+	return func(r *mux.Router) {
+		node.Register(r)
+		node.Start(nil)
+	}
+}
+
+func GetApp(opts ...Option) *mux.Router {
 	// allKeysRoute, removeKeyRoute, addKeyRoute, getKeyRoute
 	r := mux.NewRouter()
 
@@ -95,5 +107,8 @@ func GetApp() *mux.Router {
 		writer.WriteHeader(http.StatusOK)
 	}).Methods(http.MethodDelete)
 
+	for _, opt := range opts {
+		opt(r)
+	}
 	return r
 }